@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package bsdiff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a fifo can not be mapped, the commands read it instead
+	oldfn := filepath.Join(dir, "old")
+	if err := syscall.Mkfifo(oldfn, 0600); err != nil {
+		t.Skip("no fifo:", err)
+	}
+	oldbs := bytes.Repeat([]byte("bsdiff reads the old file from a fifo "), 1000)
+	newbs := append(append([]byte{}, oldbs[100:]...), "and more"...)
+	fileRoundTrip(t, dir, oldfn, newbs, func() <-chan error {
+		written := make(chan error, 1)
+		go func() {
+			written <- ioutil.WriteFile(oldfn, oldbs, 0600)
+		}()
+		return written
+	})
+}
@@ -2,10 +2,24 @@ package bsdiff
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kiteco/go-bsdiff/pkg/bsdiff"
 	"github.com/kiteco/go-bsdiff/pkg/bspatch"
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/container"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
 )
 
 func TestDiffPatch(t *testing.T) {
@@ -26,3 +40,677 @@ func TestDiffPatch(t *testing.T) {
 		t.Fatal("cover")
 	}
 }
+
+func TestDiffPatchCodecs(t *testing.T) {
+	oldbs := bytes.Repeat([]byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11}, 50)
+	newbs := append(bytes.Repeat([]byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10}, 40), 0x16)
+	for _, cd := range []codec.Codec{codec.None{}, codec.Bzip2{}, codec.Flate{}, codec.Zlib{Level: 9}, codec.Gzip{}} {
+		patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithCodec(cd))
+		if err != nil {
+			t.Fatal(cd.Name(), err.Error())
+		}
+		newbs2, err := bspatch.Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(cd.Name(), err.Error())
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal(cd.Name(), newbs2, "!=", newbs)
+		}
+	}
+	if _, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithCodec(codec.Flate{}), bsdiff.WithFormat(bsdiff.FormatBSDIFF40)); err == nil {
+		t.Fatal("BSDIFF40 can not record the flate codec")
+	}
+}
+
+func TestDiffPatchFormats(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16}
+	formats := []bsdiff.Format{
+		bsdiff.FormatAuto,
+		bsdiff.FormatBSDIFF40SHA256,
+		bsdiff.FormatBSDIFF40,
+		bsdiff.FormatBSDIFF43,
+		bsdiff.FormatExtended,
+	}
+	for _, f := range formats {
+		patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(f))
+		if err != nil {
+			t.Fatal(f, err.Error())
+		}
+		newbs2, err := bspatch.Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(f, err.Error())
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal(f, newbs2, "!=", newbs)
+		}
+	}
+}
+
+func TestDiffPatchExtensions(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE}
+	meta := container.Extension{Type: container.ExtMetadata, Value: []byte("v1.2.3")}
+	patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithExtension(meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := container.ParseHeader(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := h.Extension(container.ExtMetadata); string(v) != "v1.2.3" {
+		t.Fatal(v)
+	}
+	newbs2, err := bspatch.Bytes(oldbs, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal(newbs2, "!=", newbs)
+	}
+	if _, err := bspatch.Bytes(newbs, patch); err == nil {
+		t.Fatal("wrong old file should fail the checksum")
+	}
+
+	critical := container.Extension{Type: container.Critical | 0x4000, Value: []byte{1}}
+	patch, err = bsdiff.Bytes(oldbs, newbs, bsdiff.WithExtension(critical))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bspatch.Bytes(oldbs, patch); err == nil {
+		t.Fatal("unknown critical extension should fail")
+	}
+	if _, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithExtension(meta), bsdiff.WithFormat(bsdiff.FormatBSDIFF40)); err == nil {
+		t.Fatal("BSDIFF40 can not record extensions")
+	}
+}
+
+func TestNewFileChecksum(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE}
+	patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(bsdiff.FormatExtended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bspatch.Bytes(oldbs, patch, bspatch.WithExpectedHash(sha256.Sum256(newbs))); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bspatch.Bytes(oldbs, patch, bspatch.WithExpectedHash(sha256.Sum256(oldbs)))
+	if _, ok := err.(*bspatch.ChecksumError); !ok {
+		t.Fatal("expected a checksum error, got", err)
+	}
+
+	// corrupt the recorded new file hash
+	h, err := container.ParseHeader(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, _ := h.Extension(container.ExtNewHash)
+	sum[1] ^= 0xFF
+	_, err = bspatch.Bytes(oldbs, patch)
+	if cerr, ok := err.(*bspatch.ChecksumError); !ok || cerr.File != "newfile" {
+		t.Fatal("expected a newfile checksum error, got", err)
+	}
+}
+
+func TestOldHashAlgorithms(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE}
+	for _, alg := range []checksum.Algorithm{checksum.None, checksum.SHA256, checksum.SHA512_256, checksum.CRC64} {
+		patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithOldHash(alg))
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		newbs2, err := bspatch.Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(alg, err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal(alg, newbs2, "!=", newbs)
+		}
+		wrongOld := []byte{0xFE, 0xFA, 0xB7, 0xDD}
+		_, err = bspatch.Bytes(wrongOld, patch)
+		cerr, ok := err.(*bspatch.ChecksumError)
+		if alg == checksum.None {
+			// only the new file checksum catches it
+			if !ok || cerr.File != "newfile" {
+				t.Fatal(alg, "expected a newfile checksum error, got", err)
+			}
+			continue
+		}
+		if !ok || cerr.File != "oldfile" || cerr.Algorithm != alg {
+			t.Fatal(alg, "expected an oldfile checksum error, got", err)
+		}
+	}
+	if _, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithOldHash(checksum.CRC64), bsdiff.WithFormat(bsdiff.FormatBSDIFF40SHA256)); err == nil {
+		t.Fatal("BSDIFF40 can not record crc64")
+	}
+	if _, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithOldHash(checksum.Algorithm(99))); err == nil {
+		t.Fatal("unknown algorithm should fail")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	oldbs := bytes.Repeat([]byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11}, 5000)
+	newbs := append(bytes.Repeat([]byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10}, 4000), 0x16)
+
+	// record the phases in order, and check done never goes back in a phase
+	record := func(phases *[]progress.Phase) progress.Func {
+		var last int64
+		return func(phase progress.Phase, done, total int64) {
+			if n := len(*phases); n == 0 || (*phases)[n-1] != phase {
+				*phases = append(*phases, phase)
+				last = 0
+			}
+			if done < last || (total >= 0 && done > total) {
+				t.Fatal(phase, "progress", done, "of", total, "after", last)
+			}
+			last = done
+		}
+	}
+
+	var diffPhases []progress.Phase
+	patch, err := bsdiff.DiffContext(context.Background(), oldbs, newbs, bsdiff.WithProgress(record(&diffPhases)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []progress.Phase{progress.Sorting, progress.Hashing, progress.Scanning, progress.Compressing}
+	if !equalPhases(diffPhases, want) {
+		t.Fatal("diff phases", diffPhases, "want", want)
+	}
+
+	var patchPhases []progress.Phase
+	newbs2, err := bspatch.PatchContext(context.Background(), oldbs, patch, bspatch.WithProgress(record(&patchPhases)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal(newbs2, "!=", newbs)
+	}
+	want = []progress.Phase{progress.Hashing, progress.Applying}
+	if !equalPhases(patchPhases, want) {
+		t.Fatal("patch phases", patchPhases, "want", want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bsdiff.DiffContext(ctx, oldbs, newbs); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected a cancelled diff, got", err)
+	}
+	if _, err := bspatch.PatchContext(ctx, oldbs, patch); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected a cancelled patch, got", err)
+	}
+}
+
+func equalPhases(a, b []progress.Phase) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDifferPatcher(t *testing.T) {
+	oldbs := bytes.Repeat([]byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11}, 500)
+	newbs := append(bytes.Repeat([]byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10}, 400), 0x16)
+
+	differs := []*bsdiff.Differ{}
+	for _, opts := range [][]bsdiff.Option{
+		nil,
+		{bsdiff.WithFormat(bsdiff.FormatBSDIFF43)},
+		{bsdiff.WithCodec(codec.Zlib{}), bsdiff.WithOldHash(checksum.CRC64)},
+	} {
+		d, err := bsdiff.NewDiffer(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		differs = append(differs, d)
+	}
+	patchers := []*bspatch.Patcher{}
+	for _, opts := range [][]bspatch.Option{
+		nil,
+		{bspatch.WithCopyBufferSize(3), bspatch.WithWriteBufferSize(5)},
+		{bspatch.WithOldHashCheck(bspatch.CheckOldHashDeferred), bspatch.WithMaxNewSize(int64(len(newbs)))},
+	} {
+		p, err := bspatch.NewPatcher(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patchers = append(patchers, p)
+	}
+
+	// every combination at once, the settings must not leak between them
+	errs := make(chan error, len(differs)*len(patchers))
+	for _, d := range differs {
+		for _, p := range patchers {
+			go func(d *bsdiff.Differ, p *bspatch.Patcher) {
+				patch, err := d.Bytes(context.Background(), oldbs, newbs)
+				if err == nil {
+					var newbs2 []byte
+					newbs2, err = p.Bytes(context.Background(), oldbs, patch)
+					if err == nil && !bytes.Equal(newbs, newbs2) {
+						err = errors.New("new files differ")
+					}
+				}
+				errs <- err
+			}(d, p)
+		}
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patch, err := differs[0].Bytes(context.Background(), oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bspatch.Bytes(oldbs, patch, bspatch.WithMaxNewSize(100)); !errors.Is(err, bspatch.ErrLimit) {
+		t.Fatal("expected a limit error, got", err)
+	}
+	if _, err := bspatch.NewPatcher(bspatch.WithCopyBufferSize(0)); err == nil {
+		t.Fatal("a zero copy buffer should be rejected")
+	}
+}
+
+func TestParallel(t *testing.T) {
+	oldbs := bytes.Repeat([]byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11, 0x20}, 3000)
+	newbs := append(bytes.Repeat([]byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10}, 2000), oldbs[:5000]...)
+	for i := 0; i < len(newbs); i += 97 {
+		newbs[i] ^= byte(i)
+	}
+
+	var first []byte
+	for _, workers := range []int{1, 2, 3, 8, 0} {
+		for _, format := range []bsdiff.Format{bsdiff.FormatAuto, bsdiff.FormatBSDIFF43} {
+			patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithParallel(workers), bsdiff.WithSegmentSize(1000), bsdiff.WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format == bsdiff.FormatAuto {
+				if first == nil {
+					first = patch
+				} else if !bytes.Equal(patch, first) {
+					t.Fatal("patch with", workers, "workers differs")
+				}
+			}
+			newbs2, err := bspatch.Bytes(oldbs, patch)
+			if err != nil {
+				t.Fatal(workers, format, err)
+			}
+			if !bytes.Equal(newbs, newbs2) {
+				t.Fatal(workers, format, "new files differ")
+			}
+		}
+	}
+
+	// a few flipped bytes: every segment picks the alignment of the old file
+	// up again at its first match, so the patch stays close to a sequential one
+	rnd := rand.New(rand.NewSource(8))
+	oldbs = make([]byte, 100000)
+	rnd.Read(oldbs)
+	newbs = append([]byte{}, oldbs...)
+	for i := 0; i < len(newbs); i += 997 {
+		newbs[i] ^= 0x55
+	}
+	seq, err := bsdiff.Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithParallel(2), bsdiff.WithSegmentSize(10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) > 2*len(seq) {
+		t.Fatalf("parallel patch is %v bytes, sequential patch %v", len(patch), len(seq))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bsdiff.DiffContext(ctx, oldbs, newbs, bsdiff.WithParallel(4), bsdiff.WithSegmentSize(1000)); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected a cancelled diff, got", err)
+	}
+}
+
+func TestMatchHash(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	oldbs := make([]byte, 50000)
+	rnd.Read(oldbs)
+	newbs := append(append([]byte{}, oldbs[20000:]...), oldbs[:10000]...)
+	for i := 0; i < len(newbs); i += 333 {
+		newbs[i]++
+	}
+
+	full, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(bsdiff.FormatBSDIFF40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]bsdiff.Option{
+		{bsdiff.WithFormat(bsdiff.FormatBSDIFF40)},
+		{bsdiff.WithFormat(bsdiff.FormatBSDIFF43)},
+		{bsdiff.WithParallel(2), bsdiff.WithSegmentSize(7000)},
+	} {
+		patch, err := bsdiff.Bytes(oldbs, newbs, append(opts, bsdiff.WithMatcher(bsdiff.MatchHash))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newbs2, err := bspatch.Bytes(oldbs, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(newbs, newbs2) {
+			t.Fatal("new files differ")
+		}
+		// nearly all of the new file is found in the old one
+		if len(patch) > 2*len(full) {
+			t.Fatalf("hash matcher patch is %v bytes, suffix array patch %v", len(patch), len(full))
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	oldbs := make([]byte, 30000)
+	rnd.Read(oldbs)
+	newbs := append(append([]byte{}, oldbs[:10000]...), oldbs[15000:]...)
+	for i := 12000; i < 16000; i += 100 {
+		newbs[i]++
+	}
+
+	var got bsdiff.Strategy
+	report := func(s bsdiff.Strategy) { got = s }
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	for _, deadline := range []time.Time{past, future} {
+		for _, opts := range [][]bsdiff.Option{nil, {bsdiff.WithFormat(bsdiff.FormatBSDIFF43)}, {bsdiff.WithMatcher(bsdiff.MatchHash)}} {
+			for _, files := range [][2][]byte{{oldbs, newbs}, {oldbs, oldbs}, {oldbs, nil}, {nil, newbs}, {newbs[:20000], newbs[5000:]}} {
+				got = -1
+				patch, err := bsdiff.Bytes(files[0], files[1], append(opts, bsdiff.WithDeadline(deadline, report))...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if deadline == past && got != bsdiff.StrategyTrim {
+					t.Fatalf("patch by %v after the deadline", got)
+				}
+				newbs2, err := bspatch.Bytes(files[0], patch)
+				if err != nil {
+					t.Fatal(got, err)
+				}
+				if !bytes.Equal(newbs2, files[1]) {
+					t.Fatal(got, "new files differ")
+				}
+			}
+		}
+	}
+
+	// with time to spare the patch is the smallest of all strategies
+	for _, m := range []bsdiff.Matcher{bsdiff.MatchHash, bsdiff.MatchSuffixArray} {
+		want, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithMatcher(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithDeadline(future, report))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == bsdiff.StrategyTrim || len(patch) > len(want) {
+			t.Fatalf("patch by %v of %v bytes, %v with %v", got, len(patch), len(want), m)
+		}
+	}
+
+	// the diff returns about at the deadline, even when the strategies, and
+	// compressing the extra bytes of the fallback, take much longer
+	oldbs = make([]byte, 8<<20)
+	rnd.Read(oldbs)
+	newbs = append(append(append([]byte{}, oldbs[:1<<20]...), make([]byte, 6<<20)...), oldbs[7<<20:]...)
+	rnd.Read(newbs[2<<20 : 5<<20])
+	const budget = 200 * time.Millisecond
+	start := time.Now()
+	patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithDeadline(start.Add(budget), report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > budget+500*time.Millisecond {
+		t.Fatalf("diff with a budget of %v returned after %v", budget, elapsed)
+	}
+	newbs2, err := bspatch.Bytes(oldbs, patch)
+	if err != nil {
+		t.Fatal(got, err)
+	}
+	if !bytes.Equal(newbs2, newbs) {
+		t.Fatal(got, "new files differ")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bsdiff.DiffContext(ctx, oldbs, newbs, bsdiff.WithDeadline(future, nil)); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected a cancelled diff, got", err)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	oldbs := make([]byte, 200000)
+	rnd.Read(oldbs)
+	newbs := append(append([]byte{}, oldbs[50000:]...), oldbs[:30000]...)
+	for i := 0; i < len(newbs); i += 500 {
+		newbs[i]++
+	}
+
+	// the limit only fits the hash matcher with the blocks in temporary files
+	limit, err := bsdiff.EstimateMemory(int64(len(oldbs)), int64(len(newbs)),
+		bsdiff.WithSpillFiles(""), bsdiff.WithMatcher(bsdiff.MatchHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithMaxMemory(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashPatch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithMatcher(bsdiff.MatchHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch, hashPatch) {
+		t.Fatal("expected the patch of the hash matcher")
+	}
+
+	// the limit does not fit reading ahead
+	need, err := bspatch.EstimateMemory(patch, bspatch.WithReadAheadSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newbs2, err := bspatch.Bytes(oldbs, patch, bspatch.WithMaxMemory(need+int64(len(newbs))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newbs, newbs2) {
+		t.Fatal("new files differ")
+	}
+	if _, err := bspatch.Bytes(oldbs, patch, bspatch.WithMaxMemory(need)); !errors.Is(err, bspatch.ErrLimit) {
+		t.Fatal("expected a memory limit error, got", err)
+	}
+}
+
+func TestCompressionChunks(t *testing.T) {
+	oldbs := bytes.Repeat([]byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11, 0x20}, 3000)
+	newbs := append(bytes.Repeat([]byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10}, 2000), oldbs[:5000]...)
+	for i := 0; i < len(newbs); i += 97 {
+		newbs[i] ^= byte(i)
+	}
+
+	for _, cd := range []codec.Codec{codec.Bzip2{}, codec.Gzip{}, codec.None{}} {
+		for _, format := range []bsdiff.Format{bsdiff.FormatAuto, bsdiff.FormatBSDIFF43} {
+			if format == bsdiff.FormatBSDIFF43 && cd.ID() != codec.IDBzip2 {
+				continue
+			}
+			var first []byte
+			for _, workers := range []int{1, 3, 8} {
+				patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithCodec(cd), bsdiff.WithFormat(format),
+					bsdiff.WithCompressionChunkSize(1000), bsdiff.WithParallel(workers))
+				if err != nil {
+					t.Fatal(cd.Name(), err)
+				}
+				if first == nil {
+					first = patch
+				} else if !bytes.Equal(patch, first) {
+					t.Fatal(cd.Name(), "patch with", workers, "workers differs")
+				}
+				newbs2, err := bspatch.Bytes(oldbs, patch)
+				if err != nil {
+					t.Fatal(cd.Name(), format, err)
+				}
+				if !bytes.Equal(newbs, newbs2) {
+					t.Fatal(cd.Name(), format, "new files differ")
+				}
+			}
+		}
+	}
+
+	if _, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithCodec(codec.Zlib{}), bsdiff.WithCompressionChunkSize(1000)); err == nil {
+		t.Fatal("expected an error for a codec without multistream support")
+	}
+}
+
+func TestPatchWriterAt(t *testing.T) {
+	oldbs := bytes.Repeat([]byte{0xFF, 0xFA, 0xB7, 0xDD, 0x10, 0x11, 0x20}, 3000)
+	newbs := append(bytes.Repeat([]byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE, 0x10}, 2000), oldbs[:5000]...)
+	for i := 0; i < len(newbs); i += 97 {
+		newbs[i] ^= byte(i)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range []bsdiff.Format{bsdiff.FormatAuto, bsdiff.FormatBSDIFF40, bsdiff.FormatBSDIFF43, bsdiff.FormatExtended} {
+		patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{1, 4} {
+			newf, err := ioutil.TempFile(dir, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bspatch.WriterAt(bytes.NewReader(oldbs), newf, bytes.NewReader(patch), int64(len(patch)), bspatch.WithParallel(workers), bspatch.WithCopyBufferSize(333))
+			newf.Close()
+			if err != nil {
+				t.Fatal(format, workers, err)
+			}
+			newbs2, err := ioutil.ReadFile(newf.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(newbs, newbs2) {
+				t.Fatal(format, workers, "new files differ")
+			}
+		}
+	}
+}
+
+// maxReaderAt records the largest read from r
+type maxReaderAt struct {
+	mu  sync.Mutex
+	r   io.ReaderAt
+	max int
+}
+
+func (m *maxReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	if len(p) > m.max {
+		m.max = len(p)
+	}
+	m.mu.Unlock()
+	return m.r.ReadAt(p, off)
+}
+
+func TestPatchStream(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	oldbs := make([]byte, 256<<10)
+	rnd.Read(oldbs)
+	newbs := make([]byte, 1<<20)
+	rnd.Read(newbs)
+	copy(newbs[256<<10:], oldbs)
+
+	for _, format := range []bsdiff.Format{bsdiff.FormatAuto, bsdiff.FormatExtended} {
+		patch, err := bsdiff.Bytes(oldbs, newbs, bsdiff.WithFormat(format), bsdiff.WithCodec(codec.None{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldf := &maxReaderAt{r: bytes.NewReader(oldbs)}
+		patchf := &maxReaderAt{r: bytes.NewReader(patch)}
+		newf := new(bytes.Buffer)
+		err = bspatch.Stream(oldf, newf, patchf, int64(len(patch)), bspatch.WithCopyBufferSize(16<<10), bspatch.WithReadAheadSize(3*16<<10))
+		if err != nil {
+			t.Fatal(format, err)
+		}
+		if !bytes.Equal(newbs, newf.Bytes()) {
+			t.Fatal(format, "new files differ")
+		}
+		// the extra block alone is 768 KiB; reads are bounded by the buffers
+		if oldf.max > 64<<10 || patchf.max > 64<<10 {
+			t.Fatal(format, "reads of", oldf.max, patchf.max, "bytes")
+		}
+	}
+}
+
+// fileRoundTrip diffs the file oldfn against newbs with bsdiff.File and
+// patches it back with bspatch.File, sequentially and in parallel, as the
+// commands do. If feed is set it is called before every open of oldfn and
+// returns the result of writing it.
+func fileRoundTrip(t *testing.T, dir, oldfn string, newbs []byte, feed func() <-chan error) {
+	t.Helper()
+	open := func(f func() error) {
+		t.Helper()
+		var fed <-chan error
+		if feed != nil {
+			fed = feed()
+		}
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+		if fed != nil {
+			if err := <-fed; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	newfn, patchfn, outfn := filepath.Join(dir, "new"), filepath.Join(dir, "patch"), filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(newfn, newbs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	open(func() error { return bsdiff.File(oldfn, newfn, patchfn) })
+	for _, opts := range [][]bspatch.Option{nil, {bspatch.WithParallel(2)}} {
+		open(func() error { return bspatch.File(oldfn, outfn, patchfn, opts...) })
+		out, err := ioutil.ReadFile(outfn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, newbs) {
+			t.Fatal(len(opts), "new files differ")
+		}
+	}
+}
+
+func TestFileEmptyOld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// an empty file is not mapped
+	oldfn := filepath.Join(dir, "old")
+	if err := ioutil.WriteFile(oldfn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileRoundTrip(t, dir, oldfn, []byte("bsdiff from an empty file"), nil)
+	fileRoundTrip(t, dir, oldfn, nil, nil)
+}
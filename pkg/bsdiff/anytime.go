@@ -0,0 +1,243 @@
+package bsdiff
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// Strategy is the way a patch of WithDeadline was generated
+type Strategy int
+
+const (
+	// StrategyTrim copies the common prefix and suffix of the old and new
+	// files and adds the rest of the new file as extra bytes
+	StrategyTrim Strategy = iota
+	// StrategyHash scans with MatchHash
+	StrategyHash
+	// StrategySuffixArray scans with MatchSuffixArray
+	StrategySuffixArray
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyTrim:
+		return "trim"
+	case StrategyHash:
+		return "hash"
+	case StrategySuffixArray:
+		return "suffix array"
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// stageResult is the patch of a strategy, or the error that stopped it
+type stageResult struct {
+	strategy Strategy
+	patch    *bytes.Buffer
+	err      error
+}
+
+// diffAnytime writes the smallest patch of the matching strategies that
+// finish before c.deadline. The trimmed patch is generated concurrently as a
+// fallback, whatever the deadline, and only written when none of them
+// finishes. At the deadline the strategies still running are abandoned: they
+// stop on their own once they notice, without reporting progress anymore,
+// unless they use an Index, which is waited for. Only the context of r makes
+// it fail.
+func diffAnytime(pf io.Writer, oldbin, newbin []byte, c *config, r *progress.Reporter) error {
+	ctx := r.Context()
+	dctx, cancel := context.WithDeadline(ctx, c.deadline)
+	defer cancel()
+
+	// the fallback stops when the diff returns, it is only waited for when
+	// no strategy finished
+	tctx, cancelTrim := context.WithCancel(ctx)
+	defer cancelTrim()
+	tc := c.trimConfig()
+	trimc := make(chan stageResult, 1)
+	go func() {
+		patch := new(bytes.Buffer)
+		err := trimDiff(patch, oldbin, newbin, tc, progress.NewReporter(tctx, nil))
+		trimc <- stageResult{StrategyTrim, patch, err}
+	}()
+
+	// the abandoned strategies must not report after the diff returned
+	var mu sync.Mutex
+	returned := false
+	defer func() {
+		mu.Lock()
+		returned = true
+		mu.Unlock()
+	}()
+	var fn progress.Func
+	if c.progress != nil {
+		fn = func(phase progress.Phase, done, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !returned {
+				c.progress(phase, done, total)
+			}
+		}
+	}
+
+	stages := []Strategy{StrategyHash}
+	if c.matcher == MatchSuffixArray {
+		stages = append(stages, StrategySuffixArray)
+	}
+	stagec := make(chan stageResult, len(stages))
+	stagesDone := make(chan struct{})
+	if c.index != nil {
+		// the caller may close the index once the diff returns
+		defer func() {
+			cancel()
+			<-stagesDone
+		}()
+	}
+	go func() {
+		defer close(stagesDone)
+		sc := *c
+		sc.deadline = time.Time{}
+		dr := progress.NewReporter(dctx, fn)
+		for _, s := range stages {
+			sc.matcher = MatchHash
+			if s == StrategySuffixArray {
+				sc.matcher = MatchSuffixArray
+			}
+			patch := new(bytes.Buffer)
+			err := diff(patch, oldbin, newbin, &sc, dr)
+			stagec <- stageResult{s, patch, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var best *stageResult
+	keep := func(res stageResult) error {
+		if res.err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if dctx.Err() == nil {
+				return res.err
+			}
+			// stopped by the deadline
+			return nil
+		}
+		// on a tie the later strategy is kept, it finds better matches
+		if best == nil || res.patch.Len() <= best.patch.Len() {
+			best = &res
+		}
+		return nil
+	}
+	pending := len(stages)
+wait:
+	for pending > 0 {
+		select {
+		case res := <-stagec:
+			pending--
+			if err := keep(res); err != nil {
+				return err
+			}
+			if res.err != nil {
+				break wait
+			}
+		case <-dctx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// a strategy may have finished just in time
+			select {
+			case res := <-stagec:
+				if err := keep(res); err != nil {
+					return err
+				}
+			default:
+			}
+			break wait
+		}
+	}
+
+	if best == nil {
+		select {
+		case res := <-trimc:
+			if res.err != nil {
+				return res.err
+			}
+			best = &res
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if c.strategyFunc != nil {
+		c.strategyFunc(best.strategy)
+	}
+	_, err := best.patch.WriteTo(pf)
+	return err
+}
+
+// trimConfig returns the settings of the StrategyTrim fallback. Compressing
+// its extra bytes can take longer than the scans, so they are stored with
+// codec.None unless the format only records bzip2; FormatAuto switches to
+// FormatExtended for that.
+func (c *config) trimConfig() *config {
+	tc := *c
+	tc.deadline = time.Time{}
+	if c.autoFormat {
+		tc.format = FormatExtended
+	}
+	if tc.format == FormatExtended {
+		tc.codec = codec.None{}
+	}
+	return &tc
+}
+
+// trimDiff writes a patch of StrategyTrim
+func trimDiff(pf io.Writer, oldbin, newbin []byte, c *config, r *progress.Reporter) error {
+	pw, err := newPatchWriter(pf, oldbin, newbin, c, r)
+	if err != nil {
+		return err
+	}
+	if err = r.Start(progress.Scanning, int64(len(newbin))); err == nil {
+		if err = writeTrimmed(pw, oldbin, newbin); err == nil {
+			err = r.Finish()
+		}
+	}
+	if err != nil {
+		pw.Abort()
+		return err
+	}
+	return pw.Close()
+}
+
+// writeTrimmed hands pw the triples of the trimmed patch: the prefix as diff
+// bytes, the middle as extra bytes and the suffix as diff bytes again
+func writeTrimmed(pw patchWriter, oldbin, newbin []byte) error {
+	if len(newbin) == 0 {
+		return nil
+	}
+	pre := matchlen(oldbin, newbin)
+	suf := 0
+	for suf < len(oldbin)-pre && suf < len(newbin)-pre && oldbin[len(oldbin)-1-suf] == newbin[len(newbin)-1-suf] {
+		suf++
+	}
+	// copied bytes have diff bytes of zero
+	zeros := make([]byte, pre)
+	if suf > pre {
+		zeros = make([]byte, suf)
+	}
+	if err := pw.WriteTriple(zeros[:pre], newbin[pre:len(newbin)-suf], len(oldbin)-suf-pre); err != nil {
+		return err
+	}
+	if suf == 0 {
+		return nil
+	}
+	return pw.WriteTriple(zeros[:suf], nil, 0)
+}
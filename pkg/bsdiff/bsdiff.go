@@ -26,115 +26,147 @@
 package bsdiff
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math/bits"
 
-	"github.com/dsnet/compress/bzip2"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+	"github.com/kiteco/go-bsdiff/pkg/sufsort"
 	"github.com/kiteco/go-bsdiff/pkg/util"
 )
 
 // Bytes takes the old and new byte slices and outputs the diff
-func Bytes(oldbs, newbs []byte) ([]byte, error) {
-	return diffb(oldbs, newbs)
+func Bytes(oldbs, newbs []byte, opts ...Option) ([]byte, error) {
+	return DiffContext(context.Background(), oldbs, newbs, opts...)
 }
 
-// Reader takes the old and new binaries and outputs to a stream of the diff file
-func Reader(oldbin io.Reader, newbin io.Reader, patchf io.Writer) error {
-	oldbs, err := ioutil.ReadAll(oldbin)
+// DiffContext is like Bytes but stops early with ctx.Err() when ctx is done
+func DiffContext(ctx context.Context, oldbs, newbs []byte, opts ...Option) ([]byte, error) {
+	d, err := NewDiffer(opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	newbs, err := ioutil.ReadAll(newbin)
+	return d.Bytes(ctx, oldbs, newbs)
+}
+
+// Reader takes the old and new binaries and outputs to a stream of the diff file
+func Reader(oldbin io.Reader, newbin io.Reader, patchf io.Writer, opts ...Option) error {
+	d, err := NewDiffer(opts...)
 	if err != nil {
 		return err
 	}
-	diffbytes, err := diffb(oldbs, newbs)
+	return d.Reader(context.Background(), oldbin, newbin, patchf)
+}
+
+// Write writes the diff of the old and new byte slices to patch as it is
+// generated, without holding the whole patch in memory. patch may have
+// received part of the patch when Write fails.
+func Write(patch io.Writer, oldbs, newbs []byte, opts ...Option) error {
+	d, err := NewDiffer(opts...)
 	if err != nil {
 		return err
 	}
-	return util.PutWriter(patchf, diffbytes)
+	return d.Write(context.Background(), patch, oldbs, newbs)
 }
 
 // File reads the old and new files to create a diff patch file
-func File(oldfile, newfile, patchfile string) error {
-	oldbs, err := ioutil.ReadFile(oldfile)
-	if err != nil {
-		return fmt.Errorf("could not read oldfile '%v': %v", oldfile, err.Error())
-	}
-	newbs, err := ioutil.ReadFile(newfile)
-	if err != nil {
-		return fmt.Errorf("could not read newfile '%v': %v", newfile, err.Error())
-	}
-	diffbytes, err := diffb(oldbs, newbs)
+func File(oldfile, newfile, patchfile string, opts ...Option) error {
+	return FileContext(context.Background(), oldfile, newfile, patchfile, opts...)
+}
+
+// FileContext is like File but stops early when ctx is done; the patchfile
+// is removed then
+func FileContext(ctx context.Context, oldfile, newfile, patchfile string, opts ...Option) error {
+	d, err := NewDiffer(opts...)
 	if err != nil {
 		return fmt.Errorf("bsdiff: %v", err.Error())
 	}
-	if err := ioutil.WriteFile(patchfile, diffbytes, 0644); err != nil {
-		return fmt.Errorf("could create patchfile '%v': %v", patchfile, err.Error())
-	}
-	return nil
+	return d.File(ctx, oldfile, newfile, patchfile)
 }
 
-func diffb(oldbin, newbin []byte) ([]byte, error) {
-	// File format:
-	// --- header ---
-	//  0     -  7       : "BSDIFF40"
-	//  8     - 15       : X
-	// 16     - 23       : Y
-	// 24     - 31       : len(newfile)
-	// 32     - 63       : sha256sum(oldfile)
-	// ---  data  ---
-	// 64     - 64+X-1   : bzip2(control block)
-	// 64+X   - 64+X+Y-1 : bzip2(diff block)
-	// 64+X+Y - ??       : bzip2(extra block)
-
-	const headerLen = 64
-
-	bziprule := &bzip2.WriterConfig{
-		Level: bzip2.BestCompression,
+// diff writes the patch from oldbin to newbin to pf. Only the compressed
+// blocks are held until the end, in memory or in spill files.
+func diff(pf io.Writer, oldbin, newbin []byte, c *config, r *progress.Reporter) error {
+	c, err := c.fitMemory(int64(len(oldbin)), int64(len(newbin)))
+	if err != nil {
+		return err
+	}
+	if !c.deadline.IsZero() {
+		return diffAnytime(pf, oldbin, newbin, c, r)
 	}
-	iii := make([]int, len(oldbin)+1)
-	qsufsort(iii, oldbin)
-
-	//var db
-	var dblen, eblen int
-
-	// create the patch file
-	pf := new(util.BufWriter)
-	buf := make([]byte, 8)
-
-	newsize := len(newbin)
-	oldsize := len(oldbin)
 
-	// - header
-	// total length is 64, but the checksum (32 bytes) appends to the slice,
-	header := make([]byte, 32, headerLen)
-	copy(header, []byte("BSDIFF40"))
-	offtout(0, header[8:])
-	offtout(0, header[16:])
-	offtout(newsize, header[24:])
+	var m matcher
+	switch {
+	case c.matcher == MatchHash:
+		if m, err = newHashMatcher(oldbin, r); err != nil {
+			return err
+		}
+	case c.index != nil:
+		if !c.index.matches(oldbin) {
+			return ErrIndexMismatch
+		}
+		m = suffixMatcher{c.index.sa, oldbin}
+	default:
+		iii, err := c.sorter.Sort(oldbin, r)
+		if err != nil {
+			return err
+		}
+		// arrays of sorters such as sufsort.External hold files
+		if cl, ok := iii.(io.Closer); ok {
+			defer cl.Close()
+		}
+		m = suffixMatcher{iii, oldbin}
+	}
 
-	sum := sha256.New()
-	if _, err := sum.Write(oldbin); err != nil {
-		return nil, err
+	pw, err := newPatchWriter(pf, oldbin, newbin, c, r)
+	if err != nil {
+		return err
+	}
+	if err = r.Start(progress.Scanning, int64(len(newbin))); err != nil {
+		pw.Abort()
+		return err
 	}
-	if sum.Size() != 32 {
-		panic("unexpected: sha256sum size is not 32 bytes")
+	if c.parallel {
+		err = scanParallel(m, oldbin, newbin, pw, c.segmentSize, c.workers, r)
+	} else {
+		err = scan(m, oldbin, newbin, 0, len(newbin), pw, r)
 	}
-	header = sum.Sum(header) // appends to header
-
-	if _, err := pf.Write(header); err != nil {
-		return nil, err
+	if err == nil {
+		err = r.Finish()
 	}
-	// Compute the differences, writing ctrl as we go
-	pfbz2, err := bzip2.NewWriter(pf, bziprule)
 	if err != nil {
-		return nil, err
+		pw.Abort()
+		return err
 	}
-	var scan, ln, lastscan, lastpos, lastoffset int
+	return pw.Close()
+}
+
+// newPatchWriter returns the patchWriter of the format of c
+func newPatchWriter(pf io.Writer, oldbin, newbin []byte, c *config, r *progress.Reporter) (patchWriter, error) {
+	newSpill := newSpill(c.spillFiles, c.spillDir)
+	cp := compression{codec: c.codec, chunkSize: c.chunkSize, workers: c.workers}
+	switch c.format {
+	case FormatBSDIFF43:
+		return newBsdiff43Writer(pf, len(newbin), cp, r)
+	case FormatExtended:
+		return newExtendedWriter(pf, oldbin, newbin, cp, c.oldHash, c.extensions, newSpill, r)
+	}
+	return newBsdiff40Writer(pf, oldbin, len(newbin), c.format, cp, newSpill, r)
+}
+
+// scanStep is how far scan gets between progress reports
+const scanStep = 1 << 16
+
+// scan computes the differences between oldbin and newbin[start:end] and
+// hands every control triple, together with its diff and extra bytes, to pw.
+// The old file position starts at 0.
+func scan(m matcher, oldbin, newbin []byte, start, end int, pw patchWriter, r *progress.Reporter) error {
+	var ln, lastpos int
+	scan, lastscan := start, start
+	// a segment starts at old file offset 0, see tripleBuffer.replay
+	lastoffset := lastpos - lastscan
 
 	var oldscore, scsc int
 	var pos int
@@ -142,14 +174,13 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 	var s, Sf, lenf, Sb, lenb int
 	var overlap, Ss, lens int
 
-	db := make([]byte, newsize+1)
-	eb := make([]byte, newsize+1)
+	newsize := end // the end of the scanned range
+	oldsize := len(oldbin)
 
-	defer func() {
-		if pfbz2 != nil {
-			pfbz2.Close()
-		}
-	}()
+	// db is reused for the diff bytes of every triple
+	var db []byte
+	// the scan position of the next progress report
+	report := start + scanStep
 
 	for scan < newsize {
 		oldscore = 0
@@ -157,8 +188,14 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 		// scsc = scan += len
 		scan += ln
 		scsc = scan
+		if scan >= report {
+			if err := r.Update(int64(scan)); err != nil {
+				return err
+			}
+			report = scan + scanStep
+		}
 		for scan < newsize {
-			ln = search(iii, oldbin, newbin[scan:], 0, oldsize, &pos)
+			ln, pos = m.match(newbin[scan:newsize])
 
 			for scsc < scan+ln {
 				if scsc+lastoffset < oldsize && oldbin[scsc+lastoffset] == newbin[scsc] {
@@ -177,6 +214,12 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 			}
 			//
 			scan++
+			if scan >= report {
+				if err := r.Update(int64(scan)); err != nil {
+					return err
+				}
+				report = scan + scanStep
+			}
 		}
 
 		if ln != oldscore || scan == newsize {
@@ -233,29 +276,17 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 				lenb -= lens
 			}
 
-			for i = 0; i < lenf; i++ {
-				db[dblen+i] = newbin[lastscan+i] - oldbin[lastpos+i]
-			}
-			for i = 0; i < (scan-lenb)-(lastscan+lenf); i++ {
-				eb[eblen+i] = newbin[lastscan+lenf+i]
-			}
-
-			dblen += lenf
-			eblen += (scan - lenb) - (lastscan + lenf)
-
-			offtout(lenf, buf)
-			if _, err := pfbz2.Write(buf); err != nil {
-				return nil, err
+			if cap(db) < lenf {
+				db = make([]byte, lenf)
 			}
-
-			offtout((scan-lenb)-(lastscan+lenf), buf)
-			if _, err := pfbz2.Write(buf); err != nil {
-				return nil, err
+			db = db[:lenf]
+			for i = 0; i < lenf; i++ {
+				db[i] = newbin[lastscan+i] - oldbin[lastpos+i]
 			}
+			eb := newbin[lastscan+lenf : scan-lenb]
 
-			offtout((pos-lenb)-(lastpos+lenf), buf)
-			if _, err := pfbz2.Write(buf); err != nil {
-				return nil, err
+			if err := pw.WriteTriple(db, eb, (pos-lenb)-(lastpos+lenf)); err != nil {
+				return err
 			}
 
 			lastscan = scan - lenb
@@ -263,84 +294,60 @@ func diffb(oldbin, newbin []byte) ([]byte, error) {
 			lastoffset = pos - scan
 		}
 	}
-	if err = pfbz2.Close(); err != nil {
-		return nil, err
-	}
-
-	// Compute size of compressed ctrl data
-	ln = pf.Len()
-	offtout(ln-headerLen, header[8:])
-
-	// Write compressed diff data
-	pfbz2, err = bzip2.NewWriter(pf, bziprule)
-	if err != nil {
-		return nil, err
-	}
-	if _, err = pfbz2.Write(db[:dblen]); err != nil {
-		return nil, err
-	}
-
-	if err = pfbz2.Close(); err != nil {
-		return nil, err
-	}
-	// Compute size of compressed diff data
-	newsize = pf.Len()
-	offtout(newsize-ln, header[16:])
-	// Write compressed extra data
-	pfbz2, err = bzip2.NewWriter(pf, bziprule)
-	if err != nil {
-		return nil, err
-	}
-	if _, err = pfbz2.Write(eb[:eblen]); err != nil {
-		return nil, err
-	}
-	if err = pfbz2.Close(); err != nil {
-		return nil, err
-	}
-	// Seek to the beginning, write the header, and close the file
-	if _, err = pf.Seek(0, io.SeekStart); err != nil {
-		return nil, err
-	}
-	if _, err = pf.Write(header); err != nil {
-		return nil, err
-	}
-
-	return pf.Bytes(), nil
+	return nil
 }
 
-func search(iii []int, oldbin []byte, newbin []byte, st, en int, pos *int) int {
-	var x, y int
+// search returns the length of the longest prefix of newbin found in oldbin
+// and sets pos to its offset, by bisecting the suffix array iii between st
+// and en.
+//
+// Every suffix between two others shares at least the smaller of their
+// common prefix lengths with newbin, so each comparison can skip that many
+// bytes. This keeps repetitive inputs, where those prefixes are long, from
+// comparing the same bytes over and over.
+func search(iii sufsort.Array, oldbin []byte, newbin []byte, st, en int, pos *int) int {
 	oldsize := len(oldbin)
 	newsize := len(newbin)
 
-	if en-st < 2 {
-		x = matchlen(oldbin[iii[st]:], newbin)
-		y = matchlen(oldbin[iii[en]:], newbin)
-
-		if x > y {
-			*pos = iii[st]
-			return x
+	// stlen and enlen are the prefix lengths newbin shares with the suffixes
+	// at st and en, or lower bounds of them
+	var stlen, enlen int
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		off := iii.At(x)
+		n := util.Min(stlen, enlen)
+		n += matchlen(oldbin[off+n:], newbin[n:])
+		// as in the original bsdiff, the suffix at x only sorts before newbin
+		// if it differs first with a smaller byte; when one is a prefix of the
+		// other the search goes left
+		if n < oldsize-off && n < newsize && oldbin[off+n] < newbin[n] {
+			st, stlen = x, n
+		} else {
+			en, enlen = x, n
 		}
-		*pos = iii[en]
-		return y
 	}
 
-	x = st + (en-st)/2
-	cmpln := util.Min(oldsize-iii[x], newsize)
-	if bytes.Compare(oldbin[iii[x]:iii[x]+cmpln], newbin[:cmpln]) < 0 {
-		return search(iii, oldbin, newbin, x, en, pos)
+	x := stlen + matchlen(oldbin[iii.At(st)+stlen:], newbin[stlen:])
+	y := enlen + matchlen(oldbin[iii.At(en)+enlen:], newbin[enlen:])
+	if x > y {
+		*pos = iii.At(st)
+		return x
 	}
-	return search(iii, oldbin, newbin, st, x, pos)
+	*pos = iii.At(en)
+	return y
 }
 
+// matchlen returns the length of the common prefix of oldbin and newbin,
+// comparing eight bytes at a time
 func matchlen(oldbin []byte, newbin []byte) int {
-	var i int
-	oldsize := len(oldbin)
-	newsize := len(newbin)
-	for (i < oldsize) && (i < newsize) {
-		if oldbin[i] != newbin[i] {
-			break
+	n := util.Min(len(oldbin), len(newbin))
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		if x := binary.LittleEndian.Uint64(oldbin[i:]) ^ binary.LittleEndian.Uint64(newbin[i:]); x != 0 {
+			return i + bits.TrailingZeros64(x)/8
 		}
+	}
+	for i < n && oldbin[i] == newbin[i] {
 		i++
 	}
 	return i
@@ -381,171 +388,3 @@ func offtout(x int, buf []byte) {
 		buf[7] |= 0x80
 	}
 }
-
-func qsufsort(iii []int, buf []byte) {
-	buckets := make([]int, 256)
-	vvv := make([]int, len(iii))
-	var i, h, ln int
-	bufzise := len(buf)
-
-	// -- Phase 0 --
-	// Bucket sort (into iii) the natural numbers i = 0, ..., len(buf) based on the value buf[i].
-
-	// count number of occurrences of each byte value
-	for i = 0; i < bufzise; i++ {
-		buckets[buf[i]]++
-	}
-
-	// prefix sum of buckets -> offsets into iii where each bucket starts
-	for i = 1; i < 256; i++ {
-		buckets[i] += buckets[i-1]
-	}
-	for i = 255; i > 0; i-- {
-		buckets[i] = buckets[i-1]
-	}
-	buckets[0] = 0
-
-	// populate iii based on bucket offsets
-	for i = 0; i < bufzise; i++ {
-		buckets[buf[i]]++
-		iii[buckets[buf[i]]] = i
-	}
-	iii[0] = bufzise
-
-	// vvv is the inverse of iii: for each index i = 0, ..., len(buf), store its sort ordering in iii.
-	for i = 0; i < bufzise; i++ {
-		vvv[i] = buckets[buf[i]]
-	}
-	vvv[bufzise] = 0
-
-	// At this point, iii contains the "1-order" of buf.
-	// The "h-order" for h>0 is the ordering of
-	//   - the substrings of buf of length exactly h, and
-	//   - the suffixes of buf of length less than h
-	// Note that there are exactly n non-empty strings in the h-order for all h,
-	// uniquely identified by their start offset in buf.
-
-	// Next, we track groups of consecutive suffixes already in their final positions by
-	// storing -x at the first such suffix in each group, where x in the size of the group.
-	// This is non-destructive, since we still have vvv, the inverse of iii.
-
-	// Currently, if a bucket has size 1, it's already in its final suffix-sort order.
-	// Otherwise, it may not be. So store -1 at all size-1 bucket positions.
-	// Note that groups are not yet "coalesced," so multiple groups may be adjacent.
-	for i = 1; i < 256; i++ {
-		if buckets[i] == buckets[i-1]+1 {
-			iii[buckets[i]] = -1
-		}
-	}
-	iii[0] = -1
-
-	// -- Phase 1 --
-	// Repeatedly double h, maintaining vvv = the inverse of the h-order of buf.
-	// Coalesce groups of suffixes in their final positions, indicated by negative values in iii.
-	for h = 1; iii[0] != -(bufzise + 1); h += h {
-		ln = 0 // used to track the size of the coalesced group
-
-		i = 0
-		for i < bufzise+1 {
-			if iii[i] < 0 {
-				// at a group of suffixes in their final positions, skip it
-				ln -= iii[i]
-				i -= iii[i]
-			} else {
-				if ln != 0 {
-					// coalesce all the groups we just saw into one.
-					iii[i-ln] = -ln
-				}
-				// TODO(naman) when would this not be 1?
-				ln = vvv[iii[i]] + 1 - i
-				split(iii, vvv, i, ln, h)
-				i += ln
-				ln = 0
-			}
-		}
-		if ln != 0 {
-			iii[i-ln] = -ln
-		}
-	}
-
-	for i = 0; i < bufzise+1; i++ {
-		iii[vvv[i]] = i
-	}
-}
-
-func split(iii, vvv []int, start, ln, h int) {
-	var i, j, k, x int
-
-	if ln < 16 {
-		for k = start; k < start+ln; k += j {
-			j = 1
-			x = vvv[iii[k]+h]
-			for i = 1; k+i < start+ln; i++ {
-				if vvv[iii[k+i]+h] < x {
-					x = vvv[iii[k+i]+h]
-					j = 0
-				}
-				if vvv[iii[k+i]+h] == x {
-					iii[k+j], iii[k+i] = iii[k+i], iii[k+j]
-					j++
-				}
-			}
-			for i = 0; i < j; i++ {
-				vvv[iii[k+i]] = k + j - 1
-			}
-			if j == 1 {
-				iii[k] = -1
-			}
-		}
-		return
-	}
-
-	x = vvv[iii[start+(ln/2)]+h]
-	var jj, kk int
-	for i = start; i < start+ln; i++ {
-		if vvv[iii[i]+h] < x {
-			jj++
-		} else if vvv[iii[i]+h] == x {
-			kk++
-		}
-	}
-	jj += start
-	kk += jj
-
-	i = start
-	j = 0
-	k = 0
-	for i < jj {
-		if vvv[iii[i]+h] < x {
-			i++
-		} else if vvv[iii[i]+h] == x {
-			iii[i], iii[jj+j] = iii[jj+j], iii[i]
-			j++
-		} else {
-			iii[i], iii[kk+k] = iii[kk+k], iii[i]
-			k++
-		}
-	}
-	for jj+j < kk {
-		if vvv[iii[jj+j]+h] == x {
-			j++
-		} else {
-			iii[jj+j], iii[kk+k] = iii[kk+k], iii[jj+j]
-			k++
-		}
-	}
-	if jj > start {
-		split(iii, vvv, start, jj-start, h)
-	}
-
-	for i = 0; i < kk-jj; i++ {
-		vvv[iii[jj+i]] = kk - 1
-	}
-	if jj == kk-1 {
-		iii[jj] = -1
-	}
-
-	if start+ln > kk {
-		split(iii, vvv, kk, start+ln-kk, h)
-	}
-}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/sufsort"
 	"github.com/kiteco/go-bsdiff/pkg/util"
 )
 
@@ -44,6 +47,97 @@ func TestDiff(t *testing.T) {
 	}
 }
 
+func TestDiffClassic(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE}
+	withsum, err := Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classic, err := Bytes(oldbs, newbs, WithFormat(FormatBSDIFF40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the classic layout is the same patch without the checksum
+	if !bytes.Equal(classic[:32], withsum[:32]) || !bytes.Equal(classic[32:], withsum[64:]) {
+		t.Fatal("classic patch differs from the checksummed one\n" + hex.Dump(classic))
+	}
+	if _, err := Bytes(oldbs, newbs, WithFormat(Format(-1))); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+}
+
+func TestDiffBsdiff43(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE}
+	patch, err := Bytes(oldbs, newbs, WithFormat(FormatBSDIFF43))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(patch[:16], []byte("ENDSLEY/BSDIFF43")) {
+		t.Fatal("bad magic\n" + hex.Dump(patch))
+	}
+	if n := binary.LittleEndian.Uint64(patch[16:]); n != uint64(len(newbs)) {
+		t.Fatal(n, "!=", len(newbs))
+	}
+	if !bytes.Equal(patch[24:27], []byte("BZh")) {
+		t.Fatal("expected a bzip2 stream after the header\n" + hex.Dump(patch))
+	}
+}
+
+func TestDiffBzip2Level(t *testing.T) {
+	oldbs := []byte{0xFF, 0xFA, 0xB7, 0xDD}
+	newbs := []byte{0xFF, 0xFA, 0x90, 0xB7, 0xDD, 0xFE}
+	patch, err := Bytes(oldbs, newbs, WithBzip2Level(codec.LevelAuto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every block is tiny, so auto picks level 1 for all of them
+	if n := bytes.Count(patch, []byte("BZh1")); n != 3 {
+		t.Fatal("expected 3 level 1 bzip2 streams, got", n, "\n"+hex.Dump(patch))
+	}
+
+	// the level is picked for every block, and every chunk, on its own: the
+	// new data of 1 MiB only fills the extra block
+	rnd := rand.New(rand.NewSource(7))
+	extra := make([]byte, 1<<20)
+	rnd.Read(extra)
+	newbs = append(append([]byte{}, oldbs...), extra...)
+	levels := func(patch []byte) string {
+		ctrlLen, diffLen := binary.LittleEndian.Uint64(patch[8:]), binary.LittleEndian.Uint64(patch[16:])
+		ctrl := patch[32:]
+		diff := ctrl[ctrlLen:]
+		return string([]byte{ctrl[3], diff[3], diff[diffLen+3]})
+	}
+	patch, err = Bytes(oldbs, newbs, WithFormat(FormatBSDIFF40), WithBzip2Level(codec.LevelAuto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := levels(patch); got != "119" {
+		t.Fatal("expected levels 1, 1 and 9, got", got)
+	}
+	patch, err = Bytes(oldbs, newbs, WithFormat(FormatBSDIFF40), WithBzip2Level(codec.LevelAuto), WithCompressionChunkSize(300000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := levels(patch); got != "113" {
+		t.Fatal("expected levels 1, 1 and 3, got", got)
+	}
+	// the last chunk holds the remaining 148576 bytes
+	if n := bytes.Count(patch, []byte("BZh3")); n != 3 || !bytes.Contains(patch, []byte("BZh2")) {
+		t.Fatal("expected 3 level 3 chunks and a level 2 one, got", n)
+	}
+	if _, err = Bytes(oldbs, newbs, WithBzip2BlockSize(200000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Bytes(oldbs, newbs, WithBzip2Level(12)); err == nil {
+		t.Fatal("invalid level should fail")
+	}
+	if _, err = Bytes(oldbs, newbs, WithBzip2Level(1), WithCodec(codec.Gzip{})); err == nil {
+		t.Fatal("bzip2 level should not apply to gzip")
+	}
+}
+
 // assume the lengths are equal
 func byteDiff(expected, actual []byte) []byte {
 	diff := make([]byte, 0, len(expected))
@@ -53,6 +147,130 @@ func byteDiff(expected, actual []byte) []byte {
 	return diff
 }
 
+func TestDiffSorters(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	oldbs := make([]byte, 20000)
+	for i := range oldbs {
+		oldbs[i] = byte(rnd.Intn(8))
+	}
+	newbs := append(append([]byte{}, oldbs[5000:]...), oldbs[:3000]...)
+	newbs[100]++
+
+	// the suffix array is unique, so is the patch
+	want, err := Bytes(oldbs, newbs, WithSorter(sufsort.QSufSort{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Bytes(oldbs, newbs, WithSorter(sufsort.SAIS{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("sais patch differs from the qsufsort one")
+	}
+	got, err = Bytes(oldbs, newbs, WithSorter(sufsort.External{MemoryLimit: 64 << 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("external patch differs from the qsufsort one")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	for _, alphabet := range []int{1, 2, 4, 256} {
+		oldbs := make([]byte, 3000)
+		for i := range oldbs {
+			oldbs[i] = byte(rnd.Intn(alphabet))
+		}
+		iii, err := sufsort.SAIS{}.Sort(oldbs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 200; k++ {
+			newbs := make([]byte, 1+rnd.Intn(40))
+			copy(newbs, oldbs[rnd.Intn(len(oldbs)):])
+			if k%2 == 0 {
+				newbs[rnd.Intn(len(newbs))] = byte(rnd.Intn(alphabet))
+			}
+
+			var pos, wantPos int
+			n := search(iii, oldbs, newbs, 0, len(oldbs), &pos)
+			want := searchRecursive(iii, oldbs, newbs, 0, len(oldbs), &wantPos)
+			if n != want || pos != wantPos {
+				t.Fatalf("alphabet %v: search(% x) = %v at %v, want %v at %v", alphabet, newbs, n, pos, want, wantPos)
+			}
+		}
+	}
+}
+
+// searchRecursive is the search of the original bsdiff
+func searchRecursive(iii sufsort.Array, oldbin []byte, newbin []byte, st, en int, pos *int) int {
+	if en-st < 2 {
+		x := matchlen(oldbin[iii.At(st):], newbin)
+		y := matchlen(oldbin[iii.At(en):], newbin)
+		if x > y {
+			*pos = iii.At(st)
+			return x
+		}
+		*pos = iii.At(en)
+		return y
+	}
+	x := st + (en-st)/2
+	cmpln := util.Min(len(oldbin)-iii.At(x), len(newbin))
+	if bytes.Compare(oldbin[iii.At(x):iii.At(x)+cmpln], newbin[:cmpln]) < 0 {
+		return searchRecursive(iii, oldbin, newbin, x, en, pos)
+	}
+	return searchRecursive(iii, oldbin, newbin, st, x, pos)
+}
+
+func TestMatchlen(t *testing.T) {
+	a := []byte("0123456789abcdefghij")
+	for i := 0; i <= len(a); i++ {
+		b := append([]byte{}, a...)
+		if i < len(b) {
+			b[i] = 'X'
+		}
+		if n := matchlen(a, b); n != i {
+			t.Fatal("matchlen with a difference at", i, "is", n)
+		}
+		if n := matchlen(a[:i], a); n != i {
+			t.Fatal("matchlen of a prefix of", i, "bytes is", n)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	oldbs := make([]byte, 50000)
+	rnd.Read(oldbs)
+	newbs := append(append([]byte{}, oldbs[1000:30000]...), oldbs[:2000]...)
+	newbs[500]++
+
+	want, err := Bytes(oldbs, newbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "bsdiff-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, format := range []Format{FormatBSDIFF40SHA256, FormatExtended} {
+		var patch bytes.Buffer
+		if err := Write(&patch, oldbs, newbs, WithSpillFiles(dir), WithFormat(format)); err != nil {
+			t.Fatal(err)
+		}
+		if format == FormatBSDIFF40SHA256 && !bytes.Equal(patch.Bytes(), want) {
+			t.Fatal("streamed patch differs")
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatal("spill files left behind:", len(files))
+		}
+	}
+}
+
 func TestOfftout(t *testing.T) {
 	buf := make([]byte, 8)
 	offtout(9001, buf)
@@ -140,3 +358,179 @@ func TestFile(t *testing.T) {
 	os.Remove(t1n)
 	os.Remove(tpp)
 }
+
+func TestIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	oldbs := make([]byte, 5000)
+	for i := range oldbs {
+		oldbs[i] = byte(rnd.Intn(8))
+	}
+	newfiles := make([][]byte, 4)
+	for i := range newfiles {
+		newfiles[i] = append([]byte{}, oldbs[i*100:]...)
+		for j := 0; j < len(newfiles[i]); j += 50 + i {
+			newfiles[i][j]++
+		}
+	}
+
+	for _, sorter := range []sufsort.Sorter{sufsort.SAIS{}, sufsort.QSufSort{}, sufsort.External{MemoryLimit: 1}} {
+		x, err := NewIndex(oldbs, WithSorter(sorter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer x.Close()
+		var buf bytes.Buffer
+		n, err := x.WriteTo(&buf)
+		if err != nil || n != int64(buf.Len()) {
+			t.Fatal(n, buf.Len(), err)
+		}
+		y, err := ReadIndex(bytes.NewReader(buf.Bytes()), append([]byte{}, oldbs...))
+		if err != nil {
+			t.Fatal(sorter.Name(), err)
+		}
+
+		// diffs with either index equal a plain diff, also concurrently
+		errs := make(chan error, 2*len(newfiles))
+		for _, idx := range []*Index{x, y} {
+			for _, newbs := range newfiles {
+				go func(idx *Index, newbs []byte) {
+					expected, err := Bytes(oldbs, newbs)
+					if err != nil {
+						errs <- err
+						return
+					}
+					patch, err := Bytes(oldbs, newbs, WithIndex(idx))
+					if err == nil && !bytes.Equal(patch, expected) {
+						err = errors.New("patch with index differs")
+					}
+					errs <- err
+				}(idx, newbs)
+			}
+		}
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(sorter.Name(), err)
+			}
+		}
+
+		if _, err := Bytes(oldbs[1:], newfiles[0], WithIndex(x)); err != ErrIndexMismatch {
+			t.Fatal("expected an index mismatch, got", err)
+		}
+		if _, err := ReadIndex(bytes.NewReader(buf.Bytes()), oldbs[1:]); err != ErrIndexMismatch {
+			t.Fatal("expected an index mismatch, got", err)
+		}
+		corrupt := append([]byte{}, buf.Bytes()...)
+		corrupt[indexHeaderLen+10] ^= 1
+		if _, err := ReadIndex(bytes.NewReader(corrupt), oldbs); !errors.Is(err, ErrCorruptIndex) {
+			t.Fatal("expected a corrupt index, got", err)
+		}
+		if _, err := ReadIndex(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), oldbs); !errors.Is(err, ErrCorruptIndex) {
+			t.Fatal("expected a truncated index, got", err)
+		}
+	}
+}
+
+func TestHashMatcher(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	oldbs := make([]byte, 10000)
+	rnd.Read(oldbs)
+	m, err := newHashMatcher(oldbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// like the scan, look for a match at every position until one is found
+	for _, off := range []int{0, 1, 7, 4321, len(oldbs) - 40} {
+		newbs := append(append([]byte{}, oldbs[off:off+40]...), 0xFF^oldbs[(off+40)%len(oldbs)])
+		x := 0
+		for ; x < len(newbs); x++ {
+			if n, pos := m.match(newbs[x:]); n > 0 {
+				if pos != off+x || x+n != 40 {
+					t.Fatalf("match at %v: got %v bytes at %v from %v", off, n, pos, x)
+				}
+				break
+			}
+		}
+		if x > 2*hashStep {
+			t.Fatalf("match at %v found after %v bytes", off, x)
+		}
+	}
+	if n, _ := m.match([]byte("short")); n != 0 {
+		t.Fatal("matched", n, "bytes of a short input")
+	}
+	if n, _ := m.match(bytes.Repeat([]byte{0xAA}, 100)); n >= hashLen {
+		t.Fatal("matched", n, "bytes of unrelated data")
+	}
+
+	if _, err := NewDiffer(WithMatcher(MatchHash), WithIndex(&Index{})); err == nil {
+		t.Fatal("expected an error for an index with the hash matcher")
+	}
+	if _, err := NewDiffer(WithMatcher(Matcher(9))); err == nil {
+		t.Fatal("expected an error for an unknown matcher")
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	const oldSize, newSize = 1 << 20, 1 << 20
+	estimate := func(opts ...Option) int64 {
+		t.Helper()
+		m, err := EstimateMemory(oldSize, newSize, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	full := estimate()
+	spill := estimate(WithSpillFiles(""))
+	hash := estimate(WithSpillFiles(""), WithMatcher(MatchHash))
+	if !(hash < spill && spill < full) || full < sufsort.Memory(sufsort.SAIS{}, oldSize) {
+		t.Fatal("estimates", full, spill, hash)
+	}
+	for _, c := range []struct {
+		limit, want int64
+	}{
+		{full, full},
+		{full - 1, spill},
+		{spill - 1, hash},
+	} {
+		if got := estimate(WithMaxMemory(c.limit)); got != c.want {
+			t.Fatalf("limit %v: estimate %v, want %v", c.limit, got, c.want)
+		}
+	}
+	// an index cannot be replaced by the hash matcher
+	x, err := NewIndex(make([]byte, oldSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := estimate(WithIndex(x)); got >= spill {
+		t.Fatal("estimate with an index", got)
+	}
+
+	_, err = EstimateMemory(oldSize, newSize, WithMaxMemory(hash-1))
+	var merr *MemoryLimitError
+	if !errors.Is(err, ErrMemoryLimit) || !errors.As(err, &merr) || merr.Need != hash || merr.Limit != hash-1 {
+		t.Fatal("expected a memory limit error, got", err)
+	}
+	if _, err := Bytes(make([]byte, 100), make([]byte, 100), WithMaxMemory(1000)); !errors.Is(err, ErrMemoryLimit) {
+		t.Fatal("expected a memory limit error, got", err)
+	}
+	if _, err := Bytes(nil, nil, WithMaxMemory(-1)); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
+
+	// the buffers of single stream blocks do not grow with the workers,
+	// those of chunked blocks do
+	workers := func(n int, opts ...Option) int64 {
+		t.Helper()
+		m, err := EstimateMemory(0, 0, append(opts, WithParallel(n))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if one, many := workers(1), workers(64); one != many {
+		t.Fatal("stream estimates of", one, "and", many)
+	}
+	if one, many := workers(1, WithCompressionChunkSize(1<<20)), workers(64, WithCompressionChunkSize(1<<20)); one >= many {
+		t.Fatal("chunked estimates of", one, "and", many)
+	}
+}
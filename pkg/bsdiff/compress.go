@@ -0,0 +1,230 @@
+package bsdiff
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+)
+
+// errAborted is the error of a blockCompressor after Abort
+var errAborted = errors.New("compression aborted")
+
+// streamBufferSize is the size of the buffers handed to the goroutine
+// compressing a single stream block
+const streamBufferSize = 1 << 20
+
+// streamQueue is the number of buffers queued for the goroutine compressing a
+// single stream block. With the one it compresses and the one being filled a
+// block holds streamQueue+2 buffers.
+const streamQueue = 1
+
+// blockCompressor compresses a block into w on other goroutines.
+//
+// With a chunkSize of 0 the block is a single stream, compressed by one
+// goroutine while the next data is collected. Otherwise every chunkSize bytes
+// become a stream of their own; these are compressed concurrently, at most
+// cap(sem) at a time across all blocks sharing sem, and written to w in order.
+//
+// The codec is tuned with codec.ForSize for each stream: a chunk for its own
+// length, a single stream for its first buffer, which is the whole block or
+// already larger than any bzip2 block.
+//
+// Compression stops with the error of ctx once it is done.
+type blockCompressor struct {
+	ctx       context.Context
+	cd        codec.Codec
+	chunkSize int
+	sem       chan struct{}
+	buf       []byte
+	// queue holds the chunks in block order, done is closed once they are
+	// all written
+	queue  chan *chunk
+	done   chan struct{}
+	closed bool
+	chunks int
+
+	mu  sync.Mutex
+	err error
+}
+
+// chunk is a piece of a block; in chunked mode it is compressed into out
+type chunk struct {
+	data []byte
+	cd   codec.Codec
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+func newBlockCompressor(ctx context.Context, w io.Writer, cd codec.Codec, chunkSize int, sem chan struct{}) *blockCompressor {
+	b := &blockCompressor{
+		ctx:       ctx,
+		cd:        cd,
+		chunkSize: chunkSize,
+		sem:       sem,
+		done:      make(chan struct{}),
+	}
+	if chunkSize > 0 {
+		// enough chunks to keep the workers busy while the oldest is written
+		b.queue = make(chan *chunk, 2*cap(sem)+2)
+		go b.writeChunks(w)
+	} else {
+		b.queue = make(chan *chunk, streamQueue)
+		go b.compressStream(w)
+	}
+	return b
+}
+
+// compressStream compresses the queued data as one stream
+func (b *blockCompressor) compressStream(w io.Writer) {
+	defer close(b.done)
+	var cw io.WriteCloser
+	var err error
+	for c := range b.queue {
+		if err == nil {
+			// stop compressing the queued data after Abort
+			err = b.stopped()
+		}
+		if err == nil && cw == nil {
+			cw, err = c.cd.NewWriter(w)
+		}
+		if err == nil {
+			_, err = cw.Write(c.data)
+		}
+		if err != nil {
+			b.setErr(err)
+		}
+	}
+	if err == nil {
+		err = b.stopped()
+	}
+	if err == nil && cw != nil {
+		err = cw.Close()
+	}
+	b.setErr(err)
+}
+
+// writeChunks writes the compressed chunks in order
+func (b *blockCompressor) writeChunks(w io.Writer) {
+	defer close(b.done)
+	var err error
+	for c := range b.queue {
+		<-c.done
+		if err == nil {
+			err = c.err
+		}
+		if err == nil {
+			_, err = c.out.WriteTo(w)
+		}
+		if err != nil {
+			b.setErr(err)
+		}
+	}
+}
+
+func (b *blockCompressor) setErr(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+}
+
+func (b *blockCompressor) getErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// stopped returns the error that stops the compression, if any
+func (b *blockCompressor) stopped() error {
+	if err := b.getErr(); err != nil {
+		return err
+	}
+	return b.ctx.Err()
+}
+
+func (b *blockCompressor) Write(p []byte) (int, error) {
+	if err := b.stopped(); err != nil {
+		return 0, err
+	}
+	size := b.chunkSize
+	if size == 0 {
+		size = streamBufferSize
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if b.buf == nil {
+			b.buf = make([]byte, 0, size)
+		}
+		m := size - len(b.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		b.buf = append(b.buf, p[:m]...)
+		p = p[m:]
+		if len(b.buf) == size {
+			b.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush hands the buffered data to the compressing goroutines
+func (b *blockCompressor) flush() {
+	c := &chunk{data: b.buf, cd: codec.ForSize(b.cd, int64(len(b.buf)))}
+	b.buf = nil
+	b.chunks++
+	if b.chunkSize > 0 {
+		c.done = make(chan struct{})
+		go func() {
+			b.sem <- struct{}{}
+			defer func() { <-b.sem }()
+			defer close(c.done)
+			if err := b.stopped(); err != nil {
+				c.data, c.err = nil, err
+				return
+			}
+			cw, err := c.cd.NewWriter(&c.out)
+			if err == nil {
+				_, err = cw.Write(c.data)
+			}
+			if err == nil {
+				err = cw.Close()
+			}
+			c.data, c.err = nil, err
+		}()
+	}
+	b.queue <- c
+}
+
+// Close compresses the rest of the block and waits until all of it is written,
+// or the compression stopped
+func (b *blockCompressor) Close() error {
+	if b.closed {
+		return b.getErr()
+	}
+	// an empty block still needs a stream
+	if len(b.buf) > 0 || b.chunks == 0 {
+		b.flush()
+	}
+	b.closed = true
+	close(b.queue)
+	<-b.done
+	return b.getErr()
+}
+
+// Abort stops the compression without finishing the block
+func (b *blockCompressor) Abort() {
+	if b.closed {
+		return
+	}
+	b.setErr(errAborted)
+	b.closed = true
+	close(b.queue)
+	<-b.done
+}
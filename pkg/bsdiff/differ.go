@@ -0,0 +1,103 @@
+package bsdiff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+	"github.com/kiteco/go-bsdiff/pkg/util"
+)
+
+// Differ generates patches with a fixed set of options. Its options can not
+// change after NewDiffer, so one Differ can be used by many goroutines.
+type Differ struct {
+	c *config
+}
+
+// NewDiffer returns a Differ for the given options
+func NewDiffer(opts ...Option) (*Differ, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Differ{c}, nil
+}
+
+// Bytes takes the old and new byte slices and outputs the diff
+func (d *Differ) Bytes(ctx context.Context, oldbs, newbs []byte) ([]byte, error) {
+	var patch bytes.Buffer
+	if err := diff(&patch, oldbs, newbs, d.c, d.reporter(ctx)); err != nil {
+		return nil, err
+	}
+	return patch.Bytes(), nil
+}
+
+// Write writes the diff of the old and new byte slices to patch as it is
+// generated. patch may have received part of the patch when Write fails.
+func (d *Differ) Write(ctx context.Context, patch io.Writer, oldbs, newbs []byte) error {
+	return diff(patch, oldbs, newbs, d.c, d.reporter(ctx))
+}
+
+// Reader takes the old and new binaries and outputs to a stream of the diff file
+func (d *Differ) Reader(ctx context.Context, oldbin io.Reader, newbin io.Reader, patchf io.Writer) error {
+	oldbs, err := ioutil.ReadAll(oldbin)
+	if err != nil {
+		return err
+	}
+	newbs, err := ioutil.ReadAll(newbin)
+	if err != nil {
+		return err
+	}
+	return diff(patchf, oldbs, newbs, d.c, d.reporter(ctx))
+}
+
+// File reads the old and new files to create a diff patch file. On Linux the
+// old and new files are memory mapped rather than read onto the heap; they
+// must not be changed until File returns. With WithDeadline they are read,
+// as the strategies abandoned at the deadline may still read them afterwards.
+func (d *Differ) File(ctx context.Context, oldfile, newfile, patchfile string) error {
+	open := util.OpenMapped
+	if !d.c.deadline.IsZero() {
+		open = util.ReadFile
+	}
+	oldm, err := open(oldfile)
+	if err != nil {
+		return fmt.Errorf("could not read oldfile '%v': %v", oldfile, err.Error())
+	}
+	defer oldm.Close()
+	newm, err := open(newfile)
+	if err != nil {
+		return fmt.Errorf("could not read newfile '%v': %v", newfile, err.Error())
+	}
+	defer newm.Close()
+	// truncating a mapped input would crash the program
+	if util.SameFile(patchfile, oldfile) || util.SameFile(patchfile, newfile) {
+		return fmt.Errorf("patchfile '%v' is one of the input files", patchfile)
+	}
+	pf, err := os.OpenFile(patchfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could create patchfile '%v': %v", patchfile, err.Error())
+	}
+	pfw := bufio.NewWriter(pf)
+	if err = diff(pfw, oldm.Bytes(), newm.Bytes(), d.c, d.reporter(ctx)); err == nil {
+		err = pfw.Flush()
+	}
+	if cerr := pf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(patchfile)
+		return fmt.Errorf("bsdiff: %w", err)
+	}
+	return nil
+}
+
+// reporter returns the progress reporter of a single call
+func (d *Differ) reporter(ctx context.Context) *progress.Reporter {
+	return progress.NewReporter(ctx, d.c.progress)
+}
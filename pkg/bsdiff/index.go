@@ -0,0 +1,207 @@
+package bsdiff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kiteco/go-bsdiff/pkg/sufsort"
+)
+
+var (
+	// ErrIndexMismatch is returned when an Index is used with, or read for,
+	// an old file other than the one it was built from
+	ErrIndexMismatch = errors.New("bsdiff: index is of a different old file")
+	// ErrCorruptIndex is returned by ReadIndex for damaged or unknown data
+	ErrCorruptIndex = errors.New("bsdiff: corrupt index")
+)
+
+const indexMagic = "BSDIFFIX"
+
+// indexHeaderLen is the length of the index header, see WriteTo
+const indexHeaderLen = 56
+
+// Index is the suffix array of an old file. Building it is most of the work
+// of a diff, so an Index built once can be passed to any number of diffs of
+// the same old file with WithIndex, also concurrently.
+type Index struct {
+	old []byte
+	sa  sufsort.Array
+}
+
+// NewIndex sorts the suffixes of oldbs with the sorter of WithSorter. Only
+// the sorter and progress options apply. oldbs must not be changed while the
+// Index is in use.
+func NewIndex(oldbs []byte, opts ...Option) (*Index, error) {
+	d, err := NewDiffer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return d.Index(context.Background(), oldbs)
+}
+
+// Index sorts the suffixes of oldbs like NewIndex, stopping early with
+// ctx.Err() when ctx is done
+func (d *Differ) Index(ctx context.Context, oldbs []byte) (*Index, error) {
+	r := d.reporter(ctx)
+	sa, err := d.c.sorter.Sort(oldbs, r)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{old: oldbs, sa: sa}, nil
+}
+
+// Close releases the files of an Index sorted by sufsort.External. The
+// Index must not be used afterwards.
+func (x *Index) Close() error {
+	if cl, ok := x.sa.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// matches reports whether x is the index of oldbs
+func (x *Index) matches(oldbs []byte) bool {
+	if len(oldbs) != len(x.old) {
+		return false
+	}
+	if len(oldbs) == 0 || &oldbs[0] == &x.old[0] {
+		return true
+	}
+	return bytes.Equal(oldbs, x.old)
+}
+
+// WriteTo writes the index to w. It does not include the old file, only its
+// checksum, so ReadIndex needs the old file again.
+func (x *Index) WriteTo(w io.Writer) (int64, error) {
+	// File format:
+	//  0     -  7       : "BSDIFFIX"
+	//  8     - 15       : len(oldfile)
+	// 16     - 47       : sha256sum(oldfile)
+	// 48                : entry width, 4 or 8 bytes
+	// 49     - 55       : 0
+	// 56     - ??       : len(oldfile)+1 suffix array entries, little endian
+	// last 32 bytes     : sha256sum of everything before
+
+	width := 8
+	if _, ok := x.sa.(sufsort.Int32s); ok {
+		width = 4
+	}
+	header := make([]byte, indexHeaderLen)
+	copy(header, indexMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(x.old)))
+	oldSum := sha256.Sum256(x.old)
+	copy(header[16:], oldSum[:])
+	header[48] = byte(width)
+
+	sum := sha256.New()
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(io.MultiWriter(cw, sum))
+	bw.Write(header)
+	var buf [8]byte
+	for i := 0; i < x.sa.Len(); i++ {
+		binary.LittleEndian.PutUint64(buf[:], uint64(x.sa.At(i)))
+		if _, err := bw.Write(buf[:width]); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	_, err := cw.Write(sum.Sum(nil))
+	return cw.n, err
+}
+
+// ReadIndex reads an index written by Index.WriteTo for oldbs. It fails with
+// ErrIndexMismatch if the index is of another old file and with
+// ErrCorruptIndex if it is damaged.
+func ReadIndex(r io.Reader, oldbs []byte) (*Index, error) {
+	sum := sha256.New()
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, sum)
+
+	header := make([]byte, indexHeaderLen)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, indexReadError(err)
+	}
+	if string(header[:len(indexMagic)]) != indexMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrCorruptIndex, header[:len(indexMagic)])
+	}
+	width := int(header[48])
+	if width != 4 && width != 8 {
+		return nil, fmt.Errorf("%w: entry width %v", ErrCorruptIndex, width)
+	}
+	oldSum := sha256.Sum256(oldbs)
+	if binary.LittleEndian.Uint64(header[8:]) != uint64(len(oldbs)) || !bytes.Equal(header[16:48], oldSum[:]) {
+		return nil, ErrIndexMismatch
+	}
+
+	n := len(oldbs) + 1
+	var sa sufsort.Array
+	var at func(i int, v uint64)
+	if width == 4 {
+		a := make(sufsort.Int32s, n)
+		sa, at = a, func(i int, v uint64) { a[i] = int32(v) }
+	} else {
+		a := make(sufsort.Ints, n)
+		sa, at = a, func(i int, v uint64) { a[i] = int(v) }
+	}
+	buf := make([]byte, 64*1024/width*width)
+	for i := 0; i < n; {
+		k := len(buf) / width
+		if k > n-i {
+			k = n - i
+		}
+		if _, err := io.ReadFull(tr, buf[:k*width]); err != nil {
+			return nil, indexReadError(err)
+		}
+		for j := 0; j < k; j++ {
+			var v uint64
+			if width == 4 {
+				v = uint64(binary.LittleEndian.Uint32(buf[j*width:]))
+			} else {
+				v = binary.LittleEndian.Uint64(buf[j*width:])
+			}
+			// out of range offsets would make the scan panic
+			if v > uint64(len(oldbs)) {
+				return nil, fmt.Errorf("%w: offset %v out of range", ErrCorruptIndex, v)
+			}
+			at(i+j, v)
+		}
+		i += k
+	}
+
+	var trailer [sha256.Size]byte
+	if _, err := io.ReadFull(br, trailer[:]); err != nil {
+		return nil, indexReadError(err)
+	}
+	if !bytes.Equal(trailer[:], sum.Sum(nil)) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+	}
+	return &Index{old: oldbs, sa: sa}, nil
+}
+
+// indexReadError marks the end of the data as a truncated index
+func indexReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated", ErrCorruptIndex)
+	}
+	return err
+}
+
+// countWriter counts the bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,142 @@
+package bsdiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+	"github.com/kiteco/go-bsdiff/pkg/sufsort"
+)
+
+// Matcher selects how the scan finds the old file data matching the new file
+type Matcher int
+
+const (
+	// MatchSuffixArray searches a suffix array of the old file for the
+	// longest match at every position of the new file, as the original bsdiff
+	MatchSuffixArray Matcher = iota
+	// MatchHash looks matches up in a hash table of the old file sampled
+	// every hashStep bytes. It runs in linear time and needs about one byte
+	// of memory per old file byte, but misses matches shorter than about 16
+	// bytes and only finds some of the longer ones, so patches are larger.
+	MatchHash
+)
+
+func (m Matcher) String() string {
+	switch m {
+	case MatchSuffixArray:
+		return "suffix array"
+	case MatchHash:
+		return "hash"
+	}
+	return fmt.Sprintf("Matcher(%d)", int(m))
+}
+
+// matcher finds a match of a prefix of newbin in the old file. It returns
+// the length of the match and its offset in the old file. It is safe for
+// concurrent use.
+type matcher interface {
+	match(newbin []byte) (n, pos int)
+}
+
+// suffixMatcher finds the longest match with search
+type suffixMatcher struct {
+	iii    sufsort.Array
+	oldbin []byte
+}
+
+func (m suffixMatcher) match(newbin []byte) (int, int) {
+	var pos int
+	n := search(m.iii, m.oldbin, newbin, 0, len(m.oldbin), &pos)
+	return n, pos
+}
+
+const (
+	// hashLen is the number of bytes hashed
+	hashLen = 8
+	// hashStep is the distance of the old file offsets in the table; a match
+	// of hashLen+hashStep-1 bytes or more covers one of them
+	hashStep = 8
+	// hashWays is the number of offsets kept per hash bucket
+	hashWays = 4
+)
+
+// hashMatcher finds matches through a hash table of the hashLen bytes at
+// every hashStep-th offset of the old file. The scan calls it at every new
+// file position without a match, so a match that starts between two sampled
+// offsets is found a few bytes late and extended backwards by the scan.
+type hashMatcher struct {
+	oldbin []byte
+	// table holds hashWays entries per bucket, the sampled offset divided
+	// by hashStep plus one, or 0 if unused, most recent first
+	table []uint32
+	shift uint
+}
+
+func newHashMatcher(oldbin []byte, r *progress.Reporter) (*hashMatcher, error) {
+	if err := r.Start(progress.Sorting, int64(len(oldbin))); err != nil {
+		return nil, err
+	}
+	if uint64(len(oldbin)/hashStep) >= math.MaxUint32 {
+		return nil, fmt.Errorf("old file of %v bytes is too large for the hash matcher", len(oldbin))
+	}
+	order := hashOrder(int64(len(oldbin)))
+	m := &hashMatcher{
+		oldbin: oldbin,
+		table:  make([]uint32, hashWays<<uint(order)),
+		shift:  uint(64 - order),
+	}
+	for pos := 0; pos+hashLen <= len(oldbin); pos += hashStep {
+		b := m.bucket(oldbin[pos:])
+		copy(b[1:], b)
+		b[0] = uint32(pos/hashStep + 1)
+		if err := r.Update(int64(pos)); err != nil {
+			return nil, err
+		}
+	}
+	return m, r.Finish()
+}
+
+// hashOrder returns the log2 of the number of buckets for an old file of n
+// bytes: at least 2 buckets, and about one per hashWays samples
+func hashOrder(n int64) int {
+	order := bits.Len64(uint64(n / hashStep / hashWays))
+	if order < 1 {
+		order = 1
+	}
+	return order
+}
+
+// hashMemory returns the size of the table for an old file of n bytes
+func hashMemory(n int64) int64 {
+	return 4 * hashWays << uint(hashOrder(n))
+}
+
+// bucket returns the entries for the first hashLen bytes of p
+func (m *hashMatcher) bucket(p []byte) []uint32 {
+	h := (binary.LittleEndian.Uint64(p) * 0x9e3779b97f4a7c15) >> m.shift
+	return m.table[h*hashWays : (h+1)*hashWays]
+}
+
+func (m *hashMatcher) match(newbin []byte) (int, int) {
+	if len(newbin) < hashLen {
+		return 0, 0
+	}
+	// entries of other bytes with the same hash match less than hashLen
+	n, pos := hashLen-1, 0
+	for _, e := range m.bucket(newbin) {
+		if e == 0 {
+			break
+		}
+		off := int(e-1) * hashStep
+		if k := matchlen(m.oldbin[off:], newbin); k > n {
+			n, pos = k, off
+		}
+	}
+	if n < hashLen {
+		return 0, 0
+	}
+	return n, pos
+}
@@ -0,0 +1,123 @@
+package bsdiff
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/sufsort"
+)
+
+// ErrMemoryLimit is matched by a *MemoryLimitError
+var ErrMemoryLimit = errors.New("bsdiff: memory limit exceeded")
+
+// MemoryLimitError is returned before anything is done when a diff would
+// need more memory than WithMaxMemory allows, also with the cheaper settings
+// it falls back to. Need is the estimate of the cheapest of them.
+type MemoryLimitError struct {
+	Need  int64
+	Limit int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("bsdiff: diff needs about %v bytes of memory, more than the limit of %v", e.Need, e.Limit)
+}
+
+// Is makes MemoryLimitError match ErrMemoryLimit
+func (e *MemoryLimitError) Is(target error) bool {
+	return target == ErrMemoryLimit
+}
+
+// EstimateMemory returns about how much memory a diff of an old file of
+// oldSize bytes and a new file of newSize bytes needs with opts, not counting
+// the files themselves and the patch returned by Bytes. With WithMaxMemory it
+// is the estimate of the settings the diff falls back to, or a
+// *MemoryLimitError if none fits.
+func EstimateMemory(oldSize, newSize int64, opts ...Option) (int64, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return 0, err
+	}
+	if c, err = c.fitMemory(oldSize, newSize); err != nil {
+		return err.(*MemoryLimitError).Need, err
+	}
+	return c.memory(oldSize, newSize), nil
+}
+
+// fitMemory returns c, or a copy of c with cheaper settings, for a diff that
+// fits in c.maxMemory: the compressed blocks are kept in temporary files, and
+// then the hash matcher replaces the suffix array
+func (c *config) fitMemory(oldSize, newSize int64) (*config, error) {
+	need := c.memory(oldSize, newSize)
+	if c.maxMemory <= 0 || need <= c.maxMemory {
+		return c, nil
+	}
+	fc := *c
+	if !fc.spillFiles && fc.format != FormatBSDIFF43 {
+		fc.spillFiles, fc.spillDir = true, ""
+		if need = fc.memory(oldSize, newSize); need <= c.maxMemory {
+			return &fc, nil
+		}
+	}
+	if fc.matcher == MatchSuffixArray && fc.index == nil {
+		fc.matcher = MatchHash
+		if need = fc.memory(oldSize, newSize); need <= c.maxMemory {
+			return &fc, nil
+		}
+	}
+	return nil, &MemoryLimitError{Need: need, Limit: c.maxMemory}
+}
+
+// memory estimates the memory of a diff with c
+func (c *config) memory(oldSize, newSize int64) int64 {
+	var m int64
+	switch {
+	case c.matcher == MatchHash:
+		m = hashMemory(oldSize)
+	case c.index == nil:
+		m = sufsort.Memory(c.sorter, oldSize)
+	}
+	m += c.writerMemory(newSize)
+	if c.parallel {
+		// the triples of up to 2*workers segments wait for the writer
+		m += min64(2*int64(c.workers)*int64(c.segmentSize), newSize)
+	}
+	if !c.deadline.IsZero() {
+		// the hash matcher and the trimmed patch run besides the suffix
+		// array, and two whole patches are kept
+		m += hashMemory(oldSize) + c.writerMemory(newSize) + 2*newSize
+	}
+	return m
+}
+
+// writerMemory estimates the memory of the compressors and the compressed
+// blocks of a patch
+func (c *config) writerMemory(newSize int64) int64 {
+	blocks := int64(3)
+	if c.format == FormatBSDIFF43 {
+		blocks = 1
+	}
+	cd := codec.ForSize(c.codec, newSize)
+	var m int64
+	if c.chunkSize > 0 {
+		// every block queues 2*workers+2 chunks and fills one more; the
+		// chunks and their compressed data, compressed by at most workers
+		// writers at a time
+		buffers := int64(2*c.workers + 3)
+		m = blocks*buffers*2*int64(c.chunkSize) + int64(c.workers)*codec.WriterMemory(cd)
+	} else {
+		m = blocks * ((streamQueue+2)*streamBufferSize + codec.WriterMemory(cd))
+	}
+	if !c.spillFiles && c.format != FormatBSDIFF43 {
+		// the compressed blocks are at worst as large as the new file
+		m += newSize
+	}
+	return m
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
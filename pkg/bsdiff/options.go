@@ -0,0 +1,351 @@
+package bsdiff
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"time"
+
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/container"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+	"github.com/kiteco/go-bsdiff/pkg/sufsort"
+)
+
+// Format selects the header layout of a generated patch
+type Format int
+
+const (
+	// FormatAuto lets the package pick the layout: FormatBSDIFF40SHA256, or
+	// FormatExtended when an option needs more than BSDIFF40 can record
+	FormatAuto Format = iota
+	// FormatBSDIFF40SHA256 is the historical layout of this package: the
+	// classic 32 byte header followed by the sha256sum of the old file
+	FormatBSDIFF40SHA256
+	// FormatBSDIFF40 is the classic 32 byte header used by Colin Percival's
+	// bsdiff/bspatch and most other implementations
+	FormatBSDIFF40
+	// FormatBSDIFF43 is the single stream layout of endsley/bsdiff: a 24 byte
+	// header followed by one bzip2 stream of interleaved control, diff and
+	// extra data
+	FormatBSDIFF43
+	// FormatExtended is the versioned BSDIFFEX layout of package container,
+	// which records the codecs, the old file checksum and extension records
+	FormatExtended
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatBSDIFF40SHA256:
+		return "BSDIFF40+SHA256"
+	case FormatBSDIFF40:
+		return "BSDIFF40"
+	case FormatBSDIFF43:
+		return "ENDSLEY/BSDIFF43"
+	case FormatExtended:
+		return "BSDIFFEX"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Option configures how a patch is generated
+type Option func(*config)
+
+type config struct {
+	format Format
+	// autoFormat is set when format was picked for FormatAuto
+	autoFormat bool
+	codec      codec.Codec
+
+	bzip2Level     int
+	bzip2BlockSize int
+
+	extensions []container.Extension
+
+	oldHash    checksum.Algorithm
+	oldHashSet bool
+
+	progress progress.Func
+
+	sorter  sufsort.Sorter
+	matcher Matcher
+
+	parallel    bool
+	workers     int
+	segmentSize int
+
+	spillFiles bool
+	spillDir   string
+
+	chunkSize int
+
+	index *Index
+
+	deadline     time.Time
+	strategyFunc func(Strategy)
+
+	maxMemory int64
+}
+
+// defaultSegmentSize is the size of the new file segments scanned in parallel
+const defaultSegmentSize = 8 << 20
+
+func newConfig(opts []Option) (*config, error) {
+	c := &config{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.codec == nil {
+		c.codec = codec.Bzip2{}
+	}
+	if c.sorter == nil {
+		c.sorter = sufsort.Default
+	}
+	switch c.matcher {
+	case MatchSuffixArray:
+	case MatchHash:
+		if c.index != nil {
+			return nil, fmt.Errorf("matcher %v does not use an index", c.matcher)
+		}
+	default:
+		return nil, fmt.Errorf("unknown matcher %v", c.matcher)
+	}
+	if c.workers < 0 || c.segmentSize < 0 {
+		return nil, fmt.Errorf("invalid parallel settings (workers %v segment size %v)", c.workers, c.segmentSize)
+	}
+	if c.workers == 0 {
+		c.workers = runtime.GOMAXPROCS(0)
+	}
+	if c.segmentSize == 0 {
+		c.segmentSize = defaultSegmentSize
+	}
+	if c.maxMemory < 0 {
+		return nil, fmt.Errorf("invalid memory limit %v", c.maxMemory)
+	}
+	if c.chunkSize < 0 {
+		return nil, fmt.Errorf("invalid compression chunk size %v", c.chunkSize)
+	}
+	if c.chunkSize > 0 && !codec.Multistream(c.codec) {
+		return nil, fmt.Errorf("codec %s can not split blocks into chunks", c.codec.Name())
+	}
+	if c.bzip2Level != 0 || c.bzip2BlockSize != 0 {
+		bz2, ok := c.codec.(codec.Bzip2)
+		if !ok {
+			return nil, fmt.Errorf("bzip2 level and block size do not apply to codec %s", c.codec.Name())
+		}
+		if c.bzip2Level != 0 {
+			bz2.Level = c.bzip2Level
+		}
+		if c.bzip2BlockSize != 0 {
+			bz2.BlockSize = c.bzip2BlockSize
+		}
+		// fail early on invalid settings
+		if _, err := bz2.NewWriter(ioutil.Discard); err != nil {
+			return nil, err
+		}
+		c.codec = bz2
+	}
+	if !c.oldHashSet {
+		c.oldHash = checksum.SHA256
+	} else if c.oldHash.Size() < 0 {
+		return nil, fmt.Errorf("unknown old file hash %v", c.oldHash)
+	}
+	bz2 := c.codec.ID() == codec.IDBzip2
+	switch c.format {
+	case FormatAuto:
+		c.autoFormat = true
+		c.format = FormatBSDIFF40SHA256
+		if !bz2 || len(c.extensions) > 0 || c.oldHash != checksum.SHA256 {
+			c.format = FormatExtended
+		}
+	case FormatBSDIFF40SHA256, FormatBSDIFF40, FormatBSDIFF43:
+		if !bz2 {
+			return nil, fmt.Errorf("patch format %v can not record codec %s", c.format, c.codec.Name())
+		}
+		if len(c.extensions) > 0 {
+			return nil, fmt.Errorf("patch format %v can not record extensions", c.format)
+		}
+		if c.oldHashSet {
+			// only FormatBSDIFF40SHA256 records a checksum, and only sha256
+			wantHash := checksum.None
+			if c.format == FormatBSDIFF40SHA256 {
+				wantHash = checksum.SHA256
+			}
+			if c.oldHash != wantHash {
+				return nil, fmt.Errorf("patch format %v can not record old file hash %v", c.format, c.oldHash)
+			}
+		}
+	case FormatExtended:
+	default:
+		return nil, fmt.Errorf("unknown patch format %v", c.format)
+	}
+	return c, nil
+}
+
+// WithFormat selects the header layout of the patch
+func WithFormat(f Format) Option {
+	return func(c *config) {
+		c.format = f
+	}
+}
+
+// WithCodec selects the codec used to compress the control, diff and extra
+// blocks. The default is bzip2.
+func WithCodec(cd codec.Codec) Option {
+	return func(c *config) {
+		c.codec = cd
+	}
+}
+
+// WithBzip2Level sets the bzip2 compression level, 1 (fastest) to 9 (the
+// default), or codec.LevelAuto to pick the smallest level whose block size
+// holds each block. The patch format does not depend on the level.
+func WithBzip2Level(level int) Option {
+	return func(c *config) {
+		c.bzip2Level = level
+	}
+}
+
+// WithBzip2BlockSize sets the bzip2 block size in bytes (at most 900 kB). bzip2
+// ties the block size to the level, so it is rounded up to the next level and
+// ignored when WithBzip2Level sets an explicit level.
+func WithBzip2BlockSize(n int) Option {
+	return func(c *config) {
+		c.bzip2BlockSize = n
+	}
+}
+
+// WithExtension adds a record to the header of a FormatExtended patch, for
+// example container.ExtMetadata. Records with the container.Critical bit make
+// readers that do not know the type refuse the patch.
+func WithExtension(ext container.Extension) Option {
+	return func(c *config) {
+		c.extensions = append(c.extensions, ext)
+	}
+}
+
+// WithOldHash selects the algorithm of the old file checksum that bspatch
+// verifies before patching. The default is checksum.SHA256; checksum.None
+// leaves the checksum out. Other algorithms need FormatExtended.
+func WithOldHash(alg checksum.Algorithm) Option {
+	return func(c *config) {
+		c.oldHash = alg
+		c.oldHashSet = true
+	}
+}
+
+// WithProgress calls fn as the patch is generated with the phase
+// (progress.Hashing, Sorting, Scanning or Compressing) and the bytes done out
+// of the total of that phase
+func WithProgress(fn progress.Func) Option {
+	return func(c *config) {
+		c.progress = fn
+	}
+}
+
+// WithSorter selects the suffix array construction of the old file. The
+// default is sufsort.SAIS; sufsort.QSufSort is the algorithm of the original
+// bsdiff. The patch does not depend on the sorter.
+func WithSorter(s sufsort.Sorter) Option {
+	return func(c *config) {
+		c.sorter = s
+	}
+}
+
+// WithMatcher selects how matches are found. MatchHash trades patch size
+// for speed and memory; the sorter and index are not used then. Both write
+// the same patch formats.
+func WithMatcher(m Matcher) Option {
+	return func(c *config) {
+		c.matcher = m
+	}
+}
+
+// WithParallel scans the new file in segments on workers goroutines, or
+// GOMAXPROCS goroutines if workers is 0. The patch is the same for any
+// number of workers, but differs from the one generated without
+// WithParallel: matches do not cross segments, so every segment adds about one
+// control triple.
+func WithParallel(workers int) Option {
+	return func(c *config) {
+		c.parallel = true
+		c.workers = workers
+	}
+}
+
+// WithSegmentSize sets the size of the new file segments of WithParallel.
+// The default is 8 MiB.
+func WithSegmentSize(n int) Option {
+	return func(c *config) {
+		c.segmentSize = n
+	}
+}
+
+// WithSpillFiles keeps the compressed blocks in temporary files in dir, or
+// os.TempDir() if dir is empty, instead of memory until the patch is written.
+// The files are removed when the patch is done.
+func WithSpillFiles(dir string) Option {
+	return func(c *config) {
+		c.spillFiles = true
+		c.spillDir = dir
+	}
+}
+
+// WithCompressionChunkSize splits every block into independent streams of n
+// bytes, which are compressed concurrently on up to GOMAXPROCS goroutines, or
+// the workers of WithParallel. The codec must read concatenated streams (see
+// codec.Multistream). Readers that stop after the first stream, such as the
+// original bspatch, can not apply these patches; bspatch in this module can.
+//
+// Without it the control, diff and extra blocks are still compressed on
+// goroutines of their own, which does not change the patch.
+func WithCompressionChunkSize(n int) Option {
+	return func(c *config) {
+		c.chunkSize = n
+	}
+}
+
+// WithIndex makes diffs search x instead of sorting the old file, which must
+// be the file x was built from; other old files fail with ErrIndexMismatch.
+// The sorter is not used then.
+func WithIndex(x *Index) Option {
+	return func(c *config) {
+		c.index = x
+	}
+}
+
+// WithDeadline makes diffs return by about t with the smallest patch found
+// until then: one with MatchHash and, unless WithMatcher(MatchHash) is given,
+// one with the suffix array, while time remains. A patch that copies the
+// common prefix and suffix of the files and adds the rest is generated
+// concurrently as a fallback, whatever t, and written when neither finishes.
+// The fallback stores the rest with codec.None, as FormatExtended for
+// FormatAuto; with FormatBSDIFF40, FormatBSDIFF40SHA256 and FormatBSDIFF43,
+// which only record bzip2, compressing it can take longer than t.
+// fn, if not nil, is called with the strategy of the patch written.
+// Cancelling the context of a diff still fails it. Strategies still running at
+// t are abandoned and stop shortly after the diff returns; the old and new
+// files must not be changed until then.
+//
+// The patches are generated in memory before the best is written.
+func WithDeadline(t time.Time, fn func(Strategy)) Option {
+	return func(c *config) {
+		c.deadline = t
+		c.strategyFunc = fn
+	}
+}
+
+// WithMaxMemory limits the memory of a diff, besides the old and new files
+// and the patch returned by Bytes, to about n bytes (see EstimateMemory).
+// A diff that would need more keeps the compressed blocks in temporary files
+// as WithSpillFiles("") does and, if that is not enough, uses MatchHash
+// instead of the suffix array. If it still needs more it fails with a
+// *MemoryLimitError before anything is done.
+func WithMaxMemory(n int64) Option {
+	return func(c *config) {
+		c.maxMemory = n
+	}
+}
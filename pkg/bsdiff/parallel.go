@@ -0,0 +1,126 @@
+package bsdiff
+
+import (
+	"sync"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// scanParallel scans newbin in segments of segmentSize bytes on workers
+// goroutines and writes their triples to pw in order. Every segment is scanned
+// as if it were a file of its own, starting at old file position 0, so the
+// patch only depends on the segment size.
+func scanParallel(m matcher, oldbin, newbin []byte, pw patchWriter, segmentSize, workers int, r *progress.Reporter) error {
+	nseg := (len(newbin) + segmentSize - 1) / segmentSize
+	type segment struct {
+		triples tripleBuffer
+		err     error
+		done    chan struct{}
+	}
+	segs := make([]segment, nseg)
+	for i := range segs {
+		segs[i].done = make(chan struct{})
+	}
+
+	// at most 2*workers segments are buffered ahead of the writer
+	sem := make(chan struct{}, 2*workers)
+	next := make(chan int)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(quit)
+
+	go func() {
+		defer close(next)
+		for i := range segs {
+			select {
+			case sem <- struct{}{}:
+			case <-quit:
+				return
+			}
+			select {
+			case next <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(r *progress.Reporter) {
+			defer wg.Done()
+			r.Start(progress.Scanning, int64(len(newbin)))
+			for i := range next {
+				start, end := i*segmentSize, (i+1)*segmentSize
+				if end > len(newbin) {
+					end = len(newbin)
+				}
+				segs[i].err = scan(m, oldbin, newbin, start, end, &segs[i].triples, r)
+				close(segs[i].done)
+			}
+		}(r.Quiet())
+	}
+
+	for i := range segs {
+		<-segs[i].done
+		if segs[i].err != nil {
+			return segs[i].err
+		}
+		if err := segs[i].triples.replay(pw, i == nseg-1); err != nil {
+			return err
+		}
+		segs[i].triples = tripleBuffer{}
+		<-sem
+		end := int64(i+1) * int64(segmentSize)
+		if end > int64(len(newbin)) {
+			end = int64(len(newbin))
+		}
+		if err := r.Update(end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tripleBuffer is a patchWriter that keeps the triples of a segment until
+// they can be written in order
+type tripleBuffer struct {
+	// ctrl holds len(diff), len(extra) and seek of every triple
+	ctrl []int
+	// data holds the diff and extra bytes of every triple
+	data []byte
+}
+
+func (b *tripleBuffer) WriteTriple(diff, extra []byte, seek int) error {
+	b.ctrl = append(b.ctrl, len(diff), len(extra), seek)
+	b.data = append(b.data, diff...)
+	b.data = append(b.data, extra...)
+	return nil
+}
+
+func (b *tripleBuffer) Close() error {
+	return nil
+}
+
+func (b *tripleBuffer) Abort() {}
+
+// replay writes the triples to pw. Unless last is set, the seek of the final
+// triple is changed to return the old file position to 0 for the next segment.
+func (b *tripleBuffer) replay(pw patchWriter, last bool) error {
+	var oldpos, off int
+	for i := 0; i < len(b.ctrl); i += 3 {
+		difflen, extralen, seek := b.ctrl[i], b.ctrl[i+1], b.ctrl[i+2]
+		oldpos += difflen
+		if !last && i+3 == len(b.ctrl) {
+			seek = -oldpos
+		}
+		oldpos += seek
+		diff := b.data[off : off+difflen]
+		extra := b.data[off+difflen : off+difflen+extralen]
+		off += difflen + extralen
+		if err := pw.WriteTriple(diff, extra, seek); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package bsdiff
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/container"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// patchWriter serializes the control triples found by scan into a patch
+type patchWriter interface {
+	// WriteTriple adds the triple (len(diff), len(extra), seek) along with the
+	// diff and extra bytes it refers to
+	WriteTriple(diff, extra []byte, seek int) error
+	// Close flushes the patch; the patchWriter can not be used afterwards
+	Close() error
+	// Abort releases the patchWriter without finishing the patch
+	Abort()
+}
+
+// blockWriter writes the three block layouts: BSDIFF40 and BSDIFFEX.
+// The blocks are compressed into spills as the triples arrive and copied to
+// the patch after the header by Close.
+type blockWriter struct {
+	w io.Writer
+	// header encodes the header for the given compressed block lengths
+	header   func(ctrlLen, diffLen, extraLen int64) ([]byte, error)
+	blocks   [3]spillBlock
+	buf      [8]byte
+	progress *progress.Reporter
+}
+
+// spillBlock is a block compressing into a spill
+type spillBlock struct {
+	sp spill
+	cw *blockCompressor
+}
+
+// compression holds the settings of the block compressors
+type compression struct {
+	codec     codec.Codec
+	chunkSize int
+	workers   int
+}
+
+func newBlockWriter(w io.Writer, cp compression, newSpill func() (spill, error), r *progress.Reporter, header func(ctrlLen, diffLen, extraLen int64) ([]byte, error)) (*blockWriter, error) {
+	bw := &blockWriter{
+		w:        w,
+		header:   header,
+		progress: r,
+	}
+	sem := make(chan struct{}, cp.workers)
+	for i := range bw.blocks {
+		sp, err := newSpill()
+		if err != nil {
+			bw.release()
+			return nil, err
+		}
+		bw.blocks[i].sp = sp
+		bw.blocks[i].cw = newBlockCompressor(r.Context(), sp, cp.codec, cp.chunkSize, sem)
+	}
+	return bw, nil
+}
+
+func newBsdiff40Writer(pf io.Writer, oldbin []byte, newsize int, format Format, cp compression, newSpill func() (spill, error), r *progress.Reporter) (*blockWriter, error) {
+	// File format:
+	// --- header ---
+	//  0     -  7       : "BSDIFF40"
+	//  8     - 15       : X
+	// 16     - 23       : Y
+	// 24     - 31       : len(newfile)
+	// 32     - 63       : sha256sum(oldfile) (FormatBSDIFF40SHA256 only)
+	// ---  data  ---
+	// H     - H+X-1     : bzip2(control block)
+	// H+X   - H+X+Y-1   : bzip2(diff block)
+	// H+X+Y - ??        : bzip2(extra block)
+
+	withSum := format == FormatBSDIFF40SHA256
+	headerLen := 32
+	if withSum {
+		headerLen = 64
+	}
+
+	// - header
+	// total length is headerLen, but the checksum (32 bytes) appends to the slice,
+	header := make([]byte, 32, headerLen)
+	copy(header, []byte("BSDIFF40"))
+	offtout(newsize, header[24:])
+
+	if withSum {
+		sum := sha256.New()
+		if err := hashBytes(sum, oldbin, r); err != nil {
+			return nil, err
+		}
+		if sum.Size() != 32 {
+			panic("unexpected: sha256sum size is not 32 bytes")
+		}
+		header = sum.Sum(header) // appends to header
+	}
+
+	return newBlockWriter(pf, cp, newSpill, r, func(ctrlLen, diffLen, extraLen int64) ([]byte, error) {
+		offtout(int(ctrlLen), header[8:])
+		offtout(int(diffLen), header[16:])
+		return header, nil
+	})
+}
+
+func newExtendedWriter(pf io.Writer, oldbin, newbin []byte, cp compression, oldHash checksum.Algorithm, exts []container.Extension, newSpill func() (spill, error), r *progress.Reporter) (*blockWriter, error) {
+	// File format: see package container
+
+	newsize := len(newbin)
+	id := byte(cp.codec.ID())
+	h := &container.Header{
+		NewSize: int64(newsize),
+		Extensions: []container.Extension{
+			{Type: container.ExtCodecs, Value: []byte{id, id, id}},
+		},
+	}
+	hashes := []struct {
+		t   container.ExtType
+		alg checksum.Algorithm
+		b   []byte
+	}{
+		{container.ExtOldHash, oldHash, oldbin},
+		{container.ExtNewHash, checksum.SHA256, newbin},
+	}
+	for _, hs := range hashes {
+		if hs.alg == checksum.None {
+			continue
+		}
+		sum, err := hs.alg.New()
+		if err != nil {
+			return nil, err
+		}
+		if err = hashBytes(sum, hs.b, r); err != nil {
+			return nil, err
+		}
+		h.Extensions = append(h.Extensions, container.Extension{Type: hs.t, Value: sum.Sum([]byte{byte(hs.alg)})})
+	}
+	h.Extensions = append(h.Extensions, exts...)
+
+	return newBlockWriter(pf, cp, newSpill, r, func(ctrlLen, diffLen, extraLen int64) ([]byte, error) {
+		h.CtrlLen, h.DiffLen, h.ExtraLen = ctrlLen, diffLen, extraLen
+		return h.MarshalBinary()
+	})
+}
+
+func (w *blockWriter) WriteTriple(diff, extra []byte, seek int) error {
+	for _, x := range []int{len(diff), len(extra), seek} {
+		offtout(x, w.buf[:])
+		if _, err := w.blocks[0].cw.Write(w.buf[:]); err != nil {
+			return err
+		}
+	}
+	if _, err := w.blocks[1].cw.Write(diff); err != nil {
+		return err
+	}
+	_, err := w.blocks[2].cw.Write(extra)
+	return err
+}
+
+func (w *blockWriter) Close() error {
+	if w.blocks[0].sp == nil {
+		return nil
+	}
+	defer w.release()
+
+	// Wait for the compressors
+	var lens [3]int64
+	for i := range w.blocks {
+		err := w.blocks[i].cw.Close()
+		w.blocks[i].cw = nil
+		if err != nil {
+			return err
+		}
+		lens[i] = w.blocks[i].sp.Len()
+	}
+
+	// Write the header, then copy the compressed blocks
+	header, err := w.header(lens[0], lens[1], lens[2])
+	if err != nil {
+		return err
+	}
+	if _, err = w.w.Write(header); err != nil {
+		return err
+	}
+	if err = w.progress.Start(progress.Compressing, lens[0]+lens[1]+lens[2]); err != nil {
+		return err
+	}
+	var done int64
+	for i := range w.blocks {
+		if _, err = w.blocks[i].sp.WriteTo(w.w); err != nil {
+			return err
+		}
+		done += lens[i]
+		if err = w.progress.Update(done); err != nil {
+			return err
+		}
+	}
+	return w.progress.Finish()
+}
+
+func (w *blockWriter) Abort() {
+	w.release()
+}
+
+// release closes the compressors and spills, after an error or once the patch
+// is written
+func (w *blockWriter) release() {
+	for i := range w.blocks {
+		if w.blocks[i].cw != nil {
+			w.blocks[i].cw.Abort()
+			w.blocks[i].cw = nil
+		}
+		if w.blocks[i].sp != nil {
+			w.blocks[i].sp.Close()
+			w.blocks[i].sp = nil
+		}
+	}
+}
+
+// bsdiff43Writer writes the single stream ENDSLEY/BSDIFF43 layout
+type bsdiff43Writer struct {
+	bz       *blockCompressor
+	buf      [24]byte
+	progress *progress.Reporter
+}
+
+func newBsdiff43Writer(pf io.Writer, newsize int, cp compression, r *progress.Reporter) (*bsdiff43Writer, error) {
+	// File format:
+	// --- header ---
+	//  0     - 15       : "ENDSLEY/BSDIFF43"
+	// 16     - 23       : len(newfile)
+	// ---  data  ---
+	// 24     - ??       : bzip2(ctrl triple, diff bytes, extra bytes, ...)
+
+	header := make([]byte, 24)
+	copy(header, []byte("ENDSLEY/BSDIFF43"))
+	offtout(newsize, header[16:])
+	if _, err := pf.Write(header); err != nil {
+		return nil, err
+	}
+	bz := newBlockCompressor(r.Context(), pf, cp.codec, cp.chunkSize, make(chan struct{}, cp.workers))
+	return &bsdiff43Writer{bz: bz, progress: r}, nil
+}
+
+func (w *bsdiff43Writer) WriteTriple(diff, extra []byte, seek int) error {
+	offtout(len(diff), w.buf[0:])
+	offtout(len(extra), w.buf[8:])
+	offtout(seek, w.buf[16:])
+	for _, b := range [][]byte{w.buf[:], diff, extra} {
+		if _, err := w.bz.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort stops the compressor without writing the end of the stream
+func (w *bsdiff43Writer) Abort() {
+	if w.bz != nil {
+		w.bz.Abort()
+		w.bz = nil
+	}
+}
+
+func (w *bsdiff43Writer) Close() error {
+	if w.bz == nil {
+		return nil
+	}
+	// the data was compressed while scanning, only the last block is left
+	if err := w.progress.Start(progress.Compressing, 1); err != nil {
+		return err
+	}
+	err := w.bz.Close()
+	w.bz = nil
+	if err != nil {
+		return err
+	}
+	return w.progress.Finish()
+}
+
+// chunkSize is how much is hashed between progress reports
+const chunkSize = 1 << 20
+
+// hashBytes writes b to h in chunks, reporting the Hashing phase
+func hashBytes(h io.Writer, b []byte, r *progress.Reporter) error {
+	if err := r.Start(progress.Hashing, int64(len(b))); err != nil {
+		return err
+	}
+	for off := 0; off < len(b); off += chunkSize {
+		end := off + chunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+		h.Write(b[off:end])
+		if err := r.Update(int64(end)); err != nil {
+			return err
+		}
+	}
+	return r.Finish()
+}
@@ -0,0 +1,80 @@
+package bsdiff
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spill holds a compressed block until the patch is assembled, since the
+// header needs the lengths of all blocks first
+type spill interface {
+	io.Writer
+	// Len returns the number of bytes written
+	Len() int64
+	// WriteTo copies the content to w
+	WriteTo(w io.Writer) (int64, error)
+	// Close releases the storage
+	Close() error
+}
+
+// newSpill returns a function creating in-memory spills, or temporary files
+// in dir when files is set
+func newSpill(files bool, dir string) func() (spill, error) {
+	if !files {
+		return func() (spill, error) {
+			return &memSpill{}, nil
+		}
+	}
+	return func() (spill, error) {
+		f, err := ioutil.TempFile(dir, "bsdiff-spill-")
+		if err != nil {
+			return nil, err
+		}
+		return &fileSpill{f: f}, nil
+	}
+}
+
+type memSpill struct {
+	bytes.Buffer
+}
+
+func (s *memSpill) Len() int64 {
+	return int64(s.Buffer.Len())
+}
+
+func (s *memSpill) Close() error {
+	s.Reset()
+	return nil
+}
+
+type fileSpill struct {
+	f *os.File
+	n int64
+}
+
+func (s *fileSpill) Write(p []byte) (int, error) {
+	n, err := s.f.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *fileSpill) Len() int64 {
+	return s.n
+}
+
+func (s *fileSpill) WriteTo(w io.Writer) (int64, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.f)
+}
+
+func (s *fileSpill) Close() error {
+	err := s.f.Close()
+	if rerr := os.Remove(s.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -28,74 +28,83 @@ package bspatch
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 
-	"github.com/dsnet/compress/bzip2"
-	"github.com/kiteco/go-bsdiff/pkg/util"
-)
-
-// Variables for streaming
-var (
-	writeBufferSize = 1024 * 1024
-	copyBufferSize  = 1024 * 1024
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
 )
 
 // Bytes applies a patch with the oldfile to create the newfile
-func Bytes(oldfile, patch []byte) (newfile []byte, err error) {
-	return patchb(oldfile, patch)
+func Bytes(oldfile, patch []byte, opts ...Option) (newfile []byte, err error) {
+	return PatchContext(context.Background(), oldfile, patch, opts...)
 }
 
-// Reader applies a BSDIFF4 patch (using oldbin and patchf) to create the newbin
-func Reader(oldbin io.Reader, newbin io.Writer, patchf io.Reader) error {
-	oldbs, err := ioutil.ReadAll(oldbin)
+// PatchContext is like Bytes but stops early with ctx.Err() when ctx is done
+func PatchContext(ctx context.Context, oldfile, patch []byte, opts ...Option) (newfile []byte, err error) {
+	p, err := NewPatcher(opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	diffbytes, err := ioutil.ReadAll(patchf)
-	if err != nil {
-		return err
-	}
-	newbs, err := patchb(oldbs, diffbytes)
+	return p.Bytes(ctx, oldfile, patch)
+}
+
+// Reader applies a BSDIFF4 patch (using oldbin and patchf) to create the newbin
+func Reader(oldbin io.Reader, newbin io.Writer, patchf io.Reader, opts ...Option) error {
+	p, err := NewPatcher(opts...)
 	if err != nil {
 		return err
 	}
-	return util.PutWriter(newbin, newbs)
+	return p.Reader(context.Background(), oldbin, newbin, patchf)
 }
 
-// File applies a BSDIFF4 patch (using oldfile and patchfile) to create the newfile
-func File(oldfile, newfile, patchfile string) error {
-	oldf, err := os.Open(oldfile)
+// Stream applies the patchSize bytes long patch with oldf to create newf,
+// reading the old file and the patch as needed. Memory use does not depend on
+// the size of the files.
+func Stream(oldf io.ReaderAt, newf io.Writer, patch io.ReaderAt, patchSize int64, opts ...Option) error {
+	p, err := NewPatcher(opts...)
 	if err != nil {
-		return fmt.Errorf("could not open oldfile '%s': %v", oldfile, err)
+		return err
 	}
-	defer oldf.Close()
+	return p.Stream(context.Background(), oldf, newf, patch, patchSize)
+}
 
-	newf, err := os.Create(newfile)
+// StreamSeeker is like Stream for a patch that is an io.ReadSeeker
+func StreamSeeker(oldf io.ReaderAt, newf io.Writer, patch io.ReadSeeker, opts ...Option) error {
+	p, err := NewPatcher(opts...)
 	if err != nil {
-		return fmt.Errorf("could not open or create newfile '%s': %v", newfile, err)
+		return err
 	}
+	return p.StreamSeeker(context.Background(), oldf, newf, patch)
+}
 
-	patchbs, err := ioutil.ReadFile(patchfile)
+// WriterAt applies the patchSize bytes long patch with oldf to newf on
+// GOMAXPROCS goroutines, or the workers of WithParallel. The new file is the
+// same as the one of Bytes.
+func WriterAt(oldf io.ReaderAt, newf io.WriterAt, patch io.ReaderAt, patchSize int64, opts ...Option) error {
+	p, err := NewPatcher(opts...)
 	if err != nil {
-		return fmt.Errorf("could not read patchfile '%s': %v", patchfile, err)
+		return err
 	}
+	return p.WriterAt(context.Background(), oldf, newf, patch, patchSize)
+}
 
-	newfw := bufio.NewWriterSize(newf, writeBufferSize)
-	err = patchStream(oldf, newfw, patchbs)
+// File applies a BSDIFF4 patch (using oldfile and patchfile) to create the newfile.
+// The newfile is removed when patching fails, for example on a *ChecksumError.
+// Failures to open or write the files match ErrIO.
+func File(oldfile, newfile, patchfile string, opts ...Option) error {
+	return FileContext(context.Background(), oldfile, newfile, patchfile, opts...)
+}
 
+// FileContext is like File but stops early when ctx is done; the newfile is
+// removed then
+func FileContext(ctx context.Context, oldfile, newfile, patchfile string, opts ...Option) error {
+	p, err := NewPatcher(opts...)
 	if err != nil {
-		newf.Close()
-		os.Remove(newfile)
-		return fmt.Errorf("bspatch: %v", err)
+		return fmt.Errorf("bspatch: %w", err)
 	}
-
-	newfw.Flush()
-	newf.Close()
-	return nil
+	return p.File(ctx, oldfile, newfile, patchfile)
 }
 
 type ctrlTriple [3]int64
@@ -106,171 +115,189 @@ func (c *ctrlTriple) copy() int64 { return c[1] }
 
 func (c *ctrlTriple) seek() int64 { return c[2] }
 
-func patchStream(oldf io.ReadSeeker, newf io.Writer, patch []byte) error {
-	// File format:
-	// --- header ---
-	//  0     -  7       : "BSDIFF40"
-	//  8     - 15       : X
-	// 16     - 23       : Y
-	// 24     - 31       : len(newfile)
-	// 32     - 63       : sha256sum(oldfile)
-	// ---  data  ---
-	// 64     - 64+X-1   : bzip2(control block)
-	// 64+X   - 64+X+Y-1 : bzip2(diff block)
-	// 64+X+Y - ??       : bzip2(extra block)
+// checkLengths rejects the negative diff and extra lengths of a corrupt triple
+// read at newfile offset newpos
+func (c *ctrlTriple) checkLengths(newpos int64) error {
+	if c.sum() < 0 || c.copy() < 0 {
+		errmsg := fmt.Sprintf("negative length in control triple at newfile offset %v (diff %v extra %v)", newpos, c.sum(), c.copy())
+		return newCorruptPatchError(errmsg)
+	}
+	return nil
+}
+
+// seekError is returned when the triple ending at newfile offset newpos seeks
+// the oldfile to the negative offset oldpos
+func seekError(newpos, oldpos int64) error {
+	return newCorruptPatchError(fmt.Sprintf("control triple ending at newfile offset %v seeks the oldfile to offset %v", newpos, oldpos))
+}
 
+func patchStream(oldf oldFile, newf io.Writer, patch io.ReaderAt, patchSize int64, c *config, r *progress.Reporter) error {
 	//  The control block contains sets of triples (x,y,z) meaning:
 	//  a) add x bytes from old file to x bytes from the diff block and copy
 	//  b) copy y bytes from the extra block
 	//  c) seek in the oldfile by z bytes
 	//  Note that z can be negative.
 
-	const headerLen int64 = 64
-
-	cpBuf := make([]byte, copyBufferSize)
+	c, err := limitMemory(patch, patchSize, c, false)
+	if err != nil {
+		return err
+	}
+	cpBuf := make([]byte, c.copyBufferSize)
+	oldBuf := make([]byte, c.copyBufferSize)
 
 	// Reused container vars
-	var lenread int64
-	var errmsg string
-	header := make([]byte, headerLen)
 	hdbuf := make([]byte, 8)
 	var ctrip ctrlTriple
 
-	// Counter used for sanity checks
-	newfwc := newWriteCounter(newf)
-
-	// Read the patch header
-	p := bytes.NewReader(patch)
-	// bytes.Reader always reads as much as possible
-	n, err := p.Read(header)
-
+	pr, oldSum, newSum, err := beginPatch(oldf, patch, patchSize, c, cpBuf, r)
 	if err != nil {
-		return newCorruptPatchError(err.Error())
-	}
-	if int64(n) < headerLen {
-		errmsg = fmt.Sprintf("short header read (n %v < %v)", n, headerLen)
-		return newCorruptPatchError(errmsg)
-	}
-
-	// Check for appropriate magic
-	if bytes.Compare(header[:8], []byte("BSDIFF40")) != 0 {
-		return newCorruptPatchError("incorrect magic number (header BSDIFF40)")
-	}
-
-	// check input file checksum
-	expectedSum := header[32:]
-	sum := sha256.New()
-	if _, err := io.CopyBuffer(sum, oldf, cpBuf); err != nil {
 		return err
 	}
-	actualSum := sum.Sum(nil)
-	if !bytes.Equal(expectedSum, actualSum) {
-		return fmt.Errorf("Invalid input checksum: expected % x, but got % x", expectedSum, actualSum)
-	}
-	oldf.Seek(0, io.SeekStart) // reset oldf
-
-	// Read lengths from header
-	bzctrllen := offtin(header[8:])
-	bzdatalen := offtin(header[16:])
-	newsize := offtin(header[24:])
-	if bzctrllen < 0 || bzdatalen < 0 || newsize < 0 {
-		errmsg = fmt.Sprintf("negative length block(s) read from header (bzctrllen %v bzdatalen %v newsize %v)", bzctrllen, bzdatalen, newsize)
-		return newCorruptPatchError(errmsg)
+	// stops the read ahead goroutines and the old file check when patching
+	// fails
+	defer pr.Close()
+	defer oldSum.stop()
+	if newSum != nil {
+		newf = io.MultiWriter(newf, newSum)
 	}
 
-	// Close patch file and re-open it via libbzip2 at the right places
-	p = nil
-	ctrlbz := bytes.NewReader(patch)
-	if _, err := ctrlbz.Seek(headerLen, io.SeekStart); err != nil {
-		return err
-	}
-	ctrl, err := bzip2.NewReader(ctrlbz, nil)
-	if err != nil {
-		return err
-	}
-	databz := bytes.NewReader(patch)
-	if _, err := databz.Seek(headerLen+bzctrllen, io.SeekStart); err != nil {
-		return err
-	}
-	data, err := bzip2.NewReader(databz, nil)
-	if err != nil {
-		return err
-	}
-	xtrabz := bytes.NewReader(patch)
-	if _, err := xtrabz.Seek(headerLen+bzctrllen+bzdatalen, io.SeekStart); err != nil {
-		return err
-	}
-	xtra, err := bzip2.NewReader(xtrabz, nil)
-	if err != nil {
-		return err
-	}
+	// Counter used for sanity checks; it also reports the new file as it is
+	// written, which checks for cancellation
+	newfwc := newWriteCounter(ioWriter{newf, "write newfile"})
+	newfwc.progress = r
+	newsize, ctrl, data, xtra := pr.newsize, pr.ctrl, pr.data, pr.xtra
 
-	xbyteadd := newByteAddReader(data, oldf)
+	oldr := ioReader{oldf, "read oldfile"}
+	// oldpos follows the oldfile offset to reject seeks before its start
+	var oldpos int64
 
 	for newfwc.Count() < newsize {
 		// Read control data
 		for i := 0; i < 3; i++ {
 			lenread, err := io.ReadFull(ctrl, hdbuf)
 			if lenread != 8 || (err != nil && err != io.EOF) {
-				// format "corrupt patch or bz stream ended: control data read (lenread/8) err.Error()"
-				return newCorruptPatchBzEndError(int64(lenread), 8, "control data", err)
+				return blockReadError("control", newfwc.Count(), int64(lenread), 8, err)
 			}
 			ctrip[i] = offtin(hdbuf)
 		}
+		if err = ctrip.checkLengths(newfwc.Count()); err != nil {
+			return err
+		}
 
-		if newfwc.Count()+ctrip.sum() > newsize {
-			return newCorruptPatchError("newfile pos + data block exceeds expected newfile size")
+		if ctrip.sum() > newsize-newfwc.Count() {
+			return &ControlOverflowError{Block: "diff", Offset: newfwc.Count(), Length: ctrip.sum(), NewSize: newsize}
 		}
 
 		// Read x bytes from diff + old into new file
-		lenread, err = io.CopyBuffer(newfwc, io.LimitReader(xbyteadd, ctrip.sum()), cpBuf)
-		if lenread < ctrip.sum() || (err != nil && err != io.EOF) {
-			return newCorruptPatchBzEndError(lenread, ctrip.sum(), "x data block", err)
+		if err = copyDiff(newfwc, data, oldr, ctrip.sum(), newfwc.Count(), cpBuf, oldBuf); err != nil {
+			return err
 		}
 
-		if newfwc.Count()+ctrip.copy() > newsize {
-			return newCorruptPatchError("newfile pos + extra block exceeds expected newfile size")
+		if ctrip.copy() > newsize-newfwc.Count() {
+			return &ControlOverflowError{Block: "extra", Offset: newfwc.Count(), Length: ctrip.copy(), NewSize: newsize}
 		}
 
 		// Read bytes from the extra block into the new file
-		lenread, err = io.CopyBuffer(newfwc, io.LimitReader(xtra, ctrip.copy()), cpBuf)
-		if lenread < ctrip.copy() || (err != nil && err != io.EOF) {
-			return newCorruptPatchBzEndError(lenread, ctrip.copy(), "y extra block", err)
+		if err = copyExtra(newfwc, xtra, ctrip.copy(), newfwc.Count(), cpBuf); err != nil {
+			return err
 		}
 
 		// Adjust oldfile offset by ctrl triple
+		oldpos += ctrip.sum() + ctrip.seek()
+		if oldpos < 0 {
+			return seekError(newfwc.Count(), oldpos)
+		}
 		_, err = oldf.Seek(ctrip.seek(), io.SeekCurrent)
 		if err != nil {
-			return err
+			return &IOError{"seek oldfile", err}
 		}
 	}
 
-	// Clean up the bzip2 reads
-	if err = ctrl.Close(); err != nil {
-		return err
+	return endPatch(pr, oldSum, newSum, r)
+}
+
+// beginPatch opens the patchSize bytes long patch and starts the checks of the old and new file that
+// the patch and c ask for. The Applying phase of r is started and the blocks
+// are read ahead if c says so. oldf is rewound when a check has read it.
+func beginPatch(oldf oldFile, patch io.ReaderAt, patchSize int64, c *config, cpBuf []byte, r *progress.Reporter) (*patchReader, *deferredOldSum, *newSumWriter, error) {
+	pr, err := openPatch(patch, patchSize)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	if err = data.Close(); err != nil {
+	if c.maxNewSize > 0 && pr.newsize > c.maxNewSize {
+		pr.Close()
+		return nil, nil, nil, &LimitError{What: "newfile size", Value: pr.newsize, Limit: c.maxNewSize}
+	}
+
+	// check input file checksum
+	var oldSum *deferredOldSum
+	if pr.oldSum != nil {
+		switch c.oldHashCheck {
+		case CheckOldHashBefore:
+			if err := checkOldSum(oldf, pr.oldHash, pr.oldSum, cpBuf, r); err != nil {
+				pr.Close()
+				return nil, nil, nil, err
+			}
+			if _, err := oldf.Seek(0, io.SeekStart); err != nil { // reset oldf
+				pr.Close()
+				return nil, nil, nil, &IOError{"seek oldfile", err}
+			}
+		case CheckOldHashDeferred:
+			oldSum = startOldSum(oldf, pr.oldHash, pr.oldSum, c.copyBufferSize)
+		}
+	}
+
+	// Hash the new file as it is written when there is a checksum to verify
+	newSum, err := newNewSumWriter(
+		expectedSum{checksum.SHA256, c.expectedNewSum},
+		expectedSum{pr.newHash, pr.newSum},
+	)
+	if err == nil {
+		err = r.Start(progress.Applying, pr.newsize)
+	}
+	if err != nil {
+		pr.Close()
+		return nil, nil, nil, err
+	}
+
+	if c.readAheadSize > 0 && pr.newsize > 0 {
+		pr.readAhead(c.readAheadSize)
+	}
+	return pr, oldSum, newSum, nil
+}
+
+// endPatch closes pr once the new file is written and completes the checks
+// started by beginPatch
+func endPatch(pr *patchReader, oldSum *deferredOldSum, newSum *newSumWriter, r *progress.Reporter) error {
+	// Clean up the bzip2 reads
+	if err := pr.Close(); err != nil {
 		return err
 	}
-	if err = xtra.Close(); err != nil {
+	if err := r.Finish(); err != nil {
 		return err
 	}
-	ctrlbz = nil
-	databz = nil
-	xtrabz = nil
-	ctrl = nil
-	data = nil
-	xtra = nil
 
+	if oldSum != nil {
+		if err := oldSum.wait(); err != nil {
+			return err
+		}
+	}
+	if newSum != nil {
+		return newSum.verify()
+	}
 	return nil
 }
 
-func patchb(oldfile, patch []byte) ([]byte, error) {
+func patchb(oldfile, patch []byte, c *config, r *progress.Reporter) ([]byte, error) {
+	c, err := limitMemory(bytes.NewReader(patch), int64(len(patch)), c, true)
+	if err != nil {
+		return nil, err
+	}
 	newfby := new(bytes.Buffer)
 	// Use bufio here to emulate File()'s use of bufio for testing
-	newfbuf := bufio.NewWriterSize(newfby, writeBufferSize)
+	newfbuf := bufio.NewWriterSize(newfby, c.writeBufferSize)
 	oldfby := bytes.NewReader(oldfile)
-	err := patchStream(oldfby, newfbuf, patch)
+	err = patchStream(oldfby, newfbuf, bytes.NewReader(patch), int64(len(patch)), c, r)
 	newfbuf.Flush()
 	return newfby.Bytes(), err
 }
@@ -2,12 +2,23 @@ package bspatch
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/dsnet/compress/bzip2"
+	"github.com/kiteco/go-bsdiff/pkg/container"
 	"github.com/kiteco/go-bsdiff/pkg/util"
 )
 
@@ -70,11 +81,8 @@ func TestPatch(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		writeBufferSize = test.wbufsz
-		copyBufferSize = test.cpbufsz
-
-		desc := fmt.Sprintf("writeBufferSize: %v, copyBufferSize: %v", writeBufferSize, copyBufferSize)
-		newfile, err := Bytes(oldfile, patchfile)
+		desc := fmt.Sprintf("writeBufferSize: %v, copyBufferSize: %v", test.wbufsz, test.cpbufsz)
+		newfile, err := Bytes(oldfile, patchfile, WithWriteBufferSize(test.wbufsz), WithCopyBufferSize(test.cpbufsz))
 		if err != nil {
 			t.Errorf("With %s failed with error: %s", desc, err.Error())
 			continue
@@ -115,6 +123,42 @@ func TestReader(t *testing.T) {
 	}
 }
 
+func TestReaderPipe(t *testing.T) {
+	// pipes are *os.File without a size, they are read into memory
+	pipe := func(data []byte) *os.File {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+		return r
+	}
+	oldr, patchr := pipe(oldfile), pipe(patchfile)
+	defer oldr.Close()
+	defer patchr.Close()
+	newf := new(bytes.Buffer)
+	if err := Reader(oldr, newf, patchr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newf.Bytes())
+	}
+
+	// readers at offsets are read from their current offset
+	prefixed := bytes.NewReader(append([]byte("junk"), patchfile...))
+	prefixed.Read(make([]byte, 4))
+	newf.Reset()
+	if err := Reader(bytes.NewReader(oldfile), newf, prefixed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newf.Bytes())
+	}
+}
+
 func TestFile(t *testing.T) {
 	tf0, err := ioutil.TempFile(os.TempDir(), "")
 	if err != nil {
@@ -161,6 +205,37 @@ func TestFile(t *testing.T) {
 	os.Remove(tpp)
 }
 
+func TestFileChecksumMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldfn := filepath.Join(dir, "old")
+	newfn := filepath.Join(dir, "new")
+	patchfn := filepath.Join(dir, "patch")
+	if err := ioutil.WriteFile(oldfn, oldfile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(patchfn, patchfile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = File(oldfn, newfn, patchfn, WithExpectedHash(sha256.Sum256(oldfile)))
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) {
+		t.Fatal("expected a checksum error, got", err)
+	}
+	if cerr.File != "newfile" || len(cerr.Actual) != sha256.Size {
+		t.Fatal(cerr)
+	}
+	if _, err := os.Stat(newfn); !os.IsNotExist(err) {
+		t.Fatal("newfile should have been removed", err)
+	}
+	if err := File(oldfn, newfn, patchfn, WithExpectedHash(sha256.Sum256(newfilecomp))); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestFileErr(t *testing.T) {
 	// oldfile err
 	if err := File("__nil__", "__nil__", "__nil__"); err == nil {
@@ -249,6 +324,163 @@ func TestInvalidChecksum(t *testing.T) {
 	}
 }
 
+func TestPatchClassic(t *testing.T) {
+	// upstream patches have the same layout without the checksum
+	classic := append(append([]byte{}, patchfile[:32]...), patchfile[64:]...)
+	newfile, err := Bytes(oldfile, classic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newfile, newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newfile)
+	}
+	if _, err := Bytes(oldfile, classic[:40]); err == nil {
+		t.Fatal("truncated classic patch should fail")
+	}
+}
+
+func TestPatchBsdiff43(t *testing.T) {
+	// ctrl (1, 2, 0), diff {0}, extra {0x44, 0x45} with the old file {0x10}
+	patch43 := []byte{
+		0x45, 0x4E, 0x44, 0x53, 0x4C, 0x45, 0x59, 0x2F,
+		0x42, 0x53, 0x44, 0x49, 0x46, 0x46, 0x34, 0x33,
+		0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	raw := make([]byte, 27)
+	raw[0] = 1
+	raw[8] = 2
+	raw[25] = 0x44
+	raw[26] = 0x45
+	compressed := new(bytes.Buffer)
+	bz, err := bzip2.NewWriter(compressed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz.Write(raw)
+	bz.Close()
+	patch43 = append(patch43, compressed.Bytes()...)
+
+	newfile, err := Bytes([]byte{0x10}, patch43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newfile, []byte{0x10, 0x44, 0x45}) {
+		t.Fatal(newfile)
+	}
+	if _, err := Bytes([]byte{0x10}, patch43[:20]); err == nil {
+		t.Fatal("truncated header should fail")
+	}
+}
+
+func TestPatchUnknownCodec(t *testing.T) {
+	ids := []byte{1, 1, 250}
+	h := &container.Header{
+		NewSize:    offtin(patchfile[24:]),
+		CtrlLen:    offtin(patchfile[8:]),
+		DiffLen:    offtin(patchfile[16:]),
+		ExtraLen:   int64(len(patchfile)-64) - offtin(patchfile[8:]) - offtin(patchfile[16:]),
+		Extensions: []container.Extension{{Type: container.ExtCodecs, Value: ids}},
+	}
+	patch := func() []byte {
+		head, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(head, patchfile[64:]...)
+	}
+	_, err := Bytes(oldfile, patch())
+	var cerr *CodecError
+	if !errors.As(err, &cerr) || cerr.Block != "extra" {
+		t.Fatal("unknown codec should be a codec error, got", err)
+	}
+	ids[2] = 1
+	newfile, err := Bytes(oldfile, patch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newfile, newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newfile)
+	}
+}
+
+func TestOldHashCheck(t *testing.T) {
+	mypatch := append(make([]byte, 0, len(patchfile)), patchfile...)
+	mypatch[48] = 0
+
+	newfile, err := Bytes(oldfile, mypatch, WithOldHashCheck(CheckOldHashSkip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newfile, newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newfile)
+	}
+
+	_, err = Bytes(oldfile, mypatch, WithOldHashCheck(CheckOldHashDeferred))
+	if cerr, ok := err.(*ChecksumError); !ok || cerr.File != "oldfile" {
+		t.Fatal("expected an oldfile checksum error, got", err)
+	}
+	if _, err = Bytes(oldfile, patchfile, WithOldHashCheck(CheckOldHashDeferred)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reader reads an old file that is not an io.Seeker into memory and
+	// checks it the same way
+	newf := new(bytes.Buffer)
+	oldr := struct{ io.Reader }{bytes.NewReader(oldfile)}
+	err = Reader(oldr, newf, bytes.NewReader(mypatch), WithOldHashCheck(CheckOldHashDeferred))
+	if cerr, ok := err.(*ChecksumError); !ok || cerr.File != "oldfile" {
+		t.Fatal("expected an oldfile checksum error, got", err)
+	}
+}
+
+// slowReaderAt reads one byte at a time and counts the reads
+type slowReaderAt struct {
+	b     []byte
+	mu    sync.Mutex
+	reads int
+}
+
+func (r *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	r.mu.Lock()
+	r.reads++
+	r.mu.Unlock()
+	if off >= int64(len(r.b)) {
+		return 0, io.EOF
+	}
+	return copy(p[:1], r.b[off:]), nil
+}
+
+func (r *slowReaderAt) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reads
+}
+
+func TestOldHashCheckStopped(t *testing.T) {
+	// a new file size past the end of the control block fails patching
+	// before the old file is hashed
+	mypatch := append(make([]byte, 0, len(patchfile)), patchfile...)
+	mypatch[24] = 0xff
+	for _, parallel := range []bool{false, true} {
+		oldf := &slowReaderAt{b: oldfile}
+		var err error
+		if parallel {
+			err = WriterAt(oldf, &writerAtBuffer{}, bytes.NewReader(mypatch), int64(len(mypatch)), WithOldHashCheck(CheckOldHashDeferred), WithParallel(2))
+		} else {
+			err = Stream(oldf, ioutil.Discard, bytes.NewReader(mypatch), int64(len(mypatch)), WithOldHashCheck(CheckOldHashDeferred))
+		}
+		if err == nil {
+			t.Fatal("patch should fail")
+		}
+		reads := oldf.count()
+		time.Sleep(20 * time.Millisecond)
+		if n := oldf.count(); n != reads {
+			t.Fatal(parallel, "the old file is read after patching returned:", reads, "then", n, "reads")
+		}
+	}
+}
+
 type lowcaprdr struct {
 	read []byte
 	n    int
@@ -264,3 +496,411 @@ func (r *lowcaprdr) Read(b []byte) (int, error) {
 	r.n += len(b)
 	return len(b), nil
 }
+
+func TestErrorTaxonomy(t *testing.T) {
+	_, err := Bytes(oldfile, []byte("NOTAPATCH-------"))
+	var merr *BadMagicError
+	if !errors.As(err, &merr) || !errors.Is(err, ErrCorruptPatch) || string(merr.Magic) != "NOTAPATC" {
+		t.Fatal("expected a bad magic error, got", err)
+	}
+
+	_, err = Bytes(oldfile, patchfile[:40])
+	var terr *TruncatedBlockError
+	if !errors.As(err, &terr) || terr.Block != "header" || terr.Read != 40 || terr.Expected != 64 {
+		t.Fatal("expected a truncated header error, got", err)
+	}
+
+	// claim a newfile larger than the control block describes
+	large := append([]byte{}, patchfile...)
+	binary.LittleEndian.PutUint64(large[24:], uint64(len(newfilecomp)+10))
+	_, err = Bytes(oldfile, large)
+	if !errors.As(err, &terr) || terr.Block != "control" || terr.Offset != int64(len(newfilecomp)) || !errors.Is(err, ErrTruncated) {
+		t.Fatal("expected a truncated control block error, got", err)
+	}
+
+	// claim a newfile smaller than the first diff
+	small := append([]byte{}, patchfile...)
+	binary.LittleEndian.PutUint64(small[24:], 1)
+	_, err = Bytes(oldfile, small)
+	var oerr *ControlOverflowError
+	if !errors.As(err, &oerr) || oerr.Block != "diff" || oerr.NewSize != 1 || !errors.Is(err, ErrControlOverflow) {
+		t.Fatal("expected a control overflow error, got", err)
+	}
+
+	// a triple seeking before the start of the old file, and one with a
+	// negative diff length
+	for _, c := range []struct {
+		triples [][3]int64
+		msg     string
+	}{
+		{[][3]int64{{1, 0, -5}, {1, 0, 0}}, "seeks the oldfile to offset -4"},
+		{[][3]int64{{-1, 0, 0}}, "negative length"},
+	} {
+		patch := newPatch43(t, 2, c.triples)
+		_, err = Bytes([]byte{0x10, 0x11}, patch)
+		var perr CorruptPatchError
+		if !errors.As(err, &perr) || !strings.Contains(perr.Name, c.msg) || errors.Is(err, ErrIO) {
+			t.Fatal("expected a corrupt patch error, got", err)
+		}
+		// the same from the pieces of WriterAt
+		err = WriterAt(bytes.NewReader([]byte{0x10, 0x11}), &writerAtBuffer{}, bytes.NewReader(patch), int64(len(patch)), WithParallel(2))
+		if !errors.As(err, &perr) || !strings.Contains(perr.Name, c.msg) || errors.Is(err, ErrIO) {
+			t.Fatal("expected a corrupt patch error from WriterAt, got", err)
+		}
+	}
+
+	wrongOld := append([]byte{}, oldfile...)
+	wrongOld[0]++
+	_, err = Bytes(wrongOld, patchfile)
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) || cerr.File != "oldfile" || !errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrCorruptPatch) {
+		t.Fatal("expected an oldfile checksum error, got", err)
+	}
+
+	err = File(filepath.Join(os.TempDir(), "bspatch-does-not-exist"), filepath.Join(os.TempDir(), "bspatch-new"), "patch")
+	if !errors.Is(err, ErrIO) || !os.IsNotExist(errors.Unwrap(err)) {
+		t.Fatal("expected an I/O error, got", err)
+	}
+}
+
+// newPatch43 returns a BSDIFF43 patch of the triples, with diff bytes of zero
+// and extra bytes of 0x44
+func newPatch43(t *testing.T, newsize int64, triples [][3]int64) []byte {
+	patch := []byte("ENDSLEY/BSDIFF43")
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(newsize))
+	patch = append(patch, buf[:]...)
+	var raw []byte
+	for _, trip := range triples {
+		for _, x := range trip {
+			// offsets are stored as sign and magnitude
+			if x < 0 {
+				binary.LittleEndian.PutUint64(buf[:], uint64(-x))
+				buf[7] |= 0x80
+			} else {
+				binary.LittleEndian.PutUint64(buf[:], uint64(x))
+			}
+			raw = append(raw, buf[:]...)
+		}
+		// lengths past newsize only get the bytes that fit
+		if trip[0] > 0 {
+			raw = append(raw, make([]byte, min64(trip[0], newsize))...)
+		}
+		if trip[1] > 0 {
+			raw = append(raw, bytes.Repeat([]byte{0x44}, int(min64(trip[1], newsize)))...)
+		}
+	}
+	compressed := bytes.NewBuffer(patch)
+	bz, err := bzip2.NewWriter(compressed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bz.Write(raw)
+	bz.Close()
+	return compressed.Bytes()
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestControlOverflow(t *testing.T) {
+	// lengths that overflow int64 when added to the newfile offset
+	for _, c := range []struct {
+		triples [][3]int64
+		block   string
+	}{
+		{[][3]int64{{1, 0, 0}, {math.MaxInt64, 0, 0}}, "diff"},
+		{[][3]int64{{1, math.MaxInt64, 0}}, "extra"},
+		{[][3]int64{{0, 1, 0}, {math.MaxInt64 - 1, 0, 0}}, "diff"},
+	} {
+		patch := newPatch43(t, 2, c.triples)
+		_, err := Bytes([]byte{0x10, 0x11}, patch)
+		var oerr *ControlOverflowError
+		if !errors.As(err, &oerr) || oerr.Block != c.block || oerr.Offset != 1 {
+			t.Fatal(c.triples, "expected a control overflow error, got", err)
+		}
+		err = WriterAt(bytes.NewReader([]byte{0x10, 0x11}), &writerAtBuffer{}, bytes.NewReader(patch), int64(len(patch)), WithParallel(2))
+		if !errors.As(err, &oerr) || oerr.Block != c.block || oerr.Offset != 1 {
+			t.Fatal(c.triples, "expected a control overflow error from WriterAt, got", err)
+		}
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 5, 64, defaultReadAheadSize} {
+		newfile, err := Bytes(oldfile, patchfile, WithReadAheadSize(n))
+		if err != nil {
+			t.Fatal(n, err)
+		}
+		if !bytes.Equal(newfile, newfilecomp) {
+			t.Fatalf("read ahead size %v: expected %v, got %v", n, newfilecomp, newfile)
+		}
+	}
+	if _, err := NewPatcher(WithReadAheadSize(-1)); err == nil {
+		t.Fatal("expected an error for a negative read ahead size")
+	}
+
+	// a failing patch stops the read ahead goroutines
+	truncated := patchfile[:len(patchfile)-20]
+	if _, err := Bytes(oldfile, truncated, WithReadAheadSize(2)); !errors.Is(err, ErrCorruptPatch) && !errors.Is(err, ErrCodec) {
+		t.Fatal("expected a corrupt patch, got", err)
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	errSource := errors.New("source failed")
+	for _, size := range []int{1, 3, 64, 20000} {
+		rb := newRingBuffer(io.MultiReader(iotest.HalfReader(bytes.NewReader(data)), errReader{errSource}), size)
+		var got []byte
+		buf := make([]byte, 13)
+		var err error
+		for err == nil {
+			var n int
+			n, err = rb.Read(buf)
+			got = append(got, buf[:n]...)
+		}
+		if err != errSource {
+			t.Fatal(size, "expected the source error, got", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal(size, "data differs")
+		}
+		rb.Close()
+	}
+
+	// Close returns while the source still has data
+	rb := newRingBuffer(bytes.NewReader(data), 16)
+	rb.Read(make([]byte, 4))
+	rb.Close()
+
+	// reads after Close end once the buffered data is consumed
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for err == nil {
+			_, err = rb.Read(make([]byte, 4))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != io.ErrClosedPipe {
+			t.Fatal("expected a closed pipe error, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read after Close blocks")
+	}
+}
+
+// errReader fails every read with err
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+// writerAtBuffer is an in-memory io.WriterAt
+type writerAtBuffer struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (w *writerAtBuffer) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := int(off) + len(p); end > len(w.b) {
+		w.b = append(w.b, make([]byte, end-len(w.b))...)
+	}
+	return copy(w.b[off:], p), nil
+}
+
+func TestWriterAt(t *testing.T) {
+	for _, workers := range []int{1, 3, 0} {
+		for _, cpbufsz := range []int{1, 2, 3, 7, 50} {
+			newf := &writerAtBuffer{}
+			err := WriterAt(bytes.NewReader(oldfile), newf, bytes.NewReader(patchfile), int64(len(patchfile)), WithParallel(workers), WithCopyBufferSize(cpbufsz))
+			if err != nil {
+				t.Fatal(workers, cpbufsz, err)
+			}
+			if !bytes.Equal(newf.b, newfilecomp) {
+				t.Fatalf("workers %v copyBufferSize %v: expected %v, got %v", workers, cpbufsz, newfilecomp, newf.b)
+			}
+		}
+	}
+
+	err := WriterAt(bytes.NewReader(oldfile), &writerAtBuffer{}, bytes.NewReader(patchfile), int64(len(patchfile)), WithExpectedHash(sha256.Sum256(oldfile)))
+	var cerr *ChecksumError
+	if !errors.As(err, &cerr) || cerr.File != "newfile" {
+		t.Fatal("expected a new file checksum error, got", err)
+	}
+	// the first diff runs past the end of a shorter old file
+	err = WriterAt(bytes.NewReader(oldfile[:10]), &writerAtBuffer{}, bytes.NewReader(patchfile), int64(len(patchfile)), WithOldHashCheck(CheckOldHashSkip))
+	if !errors.Is(err, ErrCorruptPatch) {
+		t.Fatal("expected a corrupt patch error, got", err)
+	}
+	truncated := patchfile[:len(patchfile)-20]
+	if err := WriterAt(bytes.NewReader(oldfile), &writerAtBuffer{}, bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+		t.Fatal("expected an error for a truncated patch")
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldfn := filepath.Join(dir, "old")
+	newfn := filepath.Join(dir, "new")
+	patchfn := filepath.Join(dir, "patch")
+	if err := ioutil.WriteFile(oldfn, oldfile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(patchfn, patchfile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := File(oldfn, newfn, patchfn, WithParallel(2), WithCopyBufferSize(4)); err != nil {
+		t.Fatal(err)
+	}
+	if newfile, err := ioutil.ReadFile(newfn); err != nil || !bytes.Equal(newfile, newfilecomp) {
+		t.Fatal("parallel File wrote", newfile, err)
+	}
+}
+
+func TestAddBytes(t *testing.T) {
+	for n := 0; n < 40; n++ {
+		dst := make([]byte, n)
+		src := make([]byte, n)
+		want := make([]byte, n)
+		for i := range dst {
+			dst[i] = byte(i*37 + 0x70)
+			src[i] = byte(i*91 + 0x9b)
+			want[i] = dst[i] + src[i]
+		}
+		addBytes(dst, src)
+		if !bytes.Equal(dst, want) {
+			t.Fatalf("%v bytes: expected %v, got %v", n, want, dst)
+		}
+	}
+}
+
+// oneByteReadSeeker returns at most one byte per Read
+type oneByteReadSeeker struct{ *bytes.Reader }
+
+func (r oneByteReadSeeker) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.Reader.Read(p)
+}
+
+func TestShortReads(t *testing.T) {
+	newf := new(bytes.Buffer)
+	c, err := newConfig([]Option{WithCopyBufferSize(8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := patchStream(oneByteReadSeeker{bytes.NewReader(oldfile)}, newf, bytes.NewReader(patchfile), int64(len(patchfile)), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected %v, got %v", newfilecomp, newf.Bytes())
+	}
+}
+
+func BenchmarkAddBytes(b *testing.B) {
+	dst := make([]byte, 1<<20)
+	src := make([]byte, 1<<20)
+	b.SetBytes(int64(len(dst)))
+	for i := 0; i < b.N; i++ {
+		addBytes(dst, src)
+	}
+}
+
+// readSeeker hides all methods of a *bytes.Reader but Read and Seek
+type readSeeker struct{ io.ReadSeeker }
+
+// errReaderAt fails every read with err
+type errReaderAt struct{ err error }
+
+func (r errReaderAt) ReadAt(p []byte, off int64) (int, error) { return 0, r.err }
+
+func TestStream(t *testing.T) {
+	newf := new(bytes.Buffer)
+	if err := Stream(bytes.NewReader(oldfile), newf, bytes.NewReader(patchfile), int64(len(patchfile))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected %v, got %v", newfilecomp, newf.Bytes())
+	}
+
+	newf.Reset()
+	if err := StreamSeeker(bytes.NewReader(oldfile), newf, readSeeker{bytes.NewReader(patchfile)}, WithReadAheadSize(0)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected %v, got %v", newfilecomp, newf.Bytes())
+	}
+
+	// Reader reads plain readers into memory
+	newf.Reset()
+	if err := Reader(readSeeker{bytes.NewReader(oldfile)}, newf, readSeeker{bytes.NewReader(patchfile)}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected %v, got %v", newfilecomp, newf.Bytes())
+	}
+
+	errPatch := errors.New("patch failed")
+	err := Stream(bytes.NewReader(oldfile), new(bytes.Buffer), errReaderAt{errPatch}, int64(len(patchfile)))
+	if !errors.Is(err, ErrIO) || !errors.Is(err, errPatch) {
+		t.Fatal("expected an I/O error, got", err)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	est, err := EstimateMemory(patchfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noReadAhead, err := EstimateMemory(patchfile, WithReadAheadSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noReadAhead != est-defaultReadAheadSize {
+		t.Fatal("estimates", est, noReadAhead)
+	}
+	// over the limit the blocks are not read ahead
+	if got, err := EstimateMemory(patchfile, WithMaxMemory(est-1)); err != nil || got != noReadAhead {
+		t.Fatal("estimate with a limit", got, err)
+	}
+
+	// Bytes also holds the new file of 19 bytes
+	limit := WithMaxMemory(noReadAhead + 10)
+	var newf bytes.Buffer
+	if err := Stream(bytes.NewReader(oldfile), &newf, bytes.NewReader(patchfile), int64(len(patchfile)), limit); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newf.Bytes(), newfilecomp) {
+		t.Fatalf("expected: %v, got: %v", newfilecomp, newf.Bytes())
+	}
+	_, err = Bytes(oldfile, patchfile, limit)
+	var lerr *LimitError
+	if !errors.Is(err, ErrLimit) || !errors.As(err, &lerr) || lerr.Value != noReadAhead+int64(len(newfilecomp)) {
+		t.Fatal("expected a memory limit error, got", err)
+	}
+	if _, err := EstimateMemory(patchfile, WithMaxMemory(1000)); !errors.Is(err, ErrLimit) {
+		t.Fatal("expected a memory limit error, got", err)
+	}
+
+	if _, err := EstimateMemory(patchfile[:20]); !errors.Is(err, ErrTruncated) {
+		t.Fatal("expected a truncated header, got", err)
+	}
+	if _, err := EstimateMemory([]byte("NOTAPATCH-------------------------")); !errors.Is(err, ErrBadMagic) {
+		t.Fatal("expected a bad magic, got", err)
+	}
+}
@@ -0,0 +1,159 @@
+package bspatch
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"math"
+	"os"
+
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// sizeOf returns the size of r if it is a regular file or a buffer, or -1.
+// Pipes and devices are files of no meaningful size. The offset of r is left
+// as is.
+func sizeOf(r interface{}) int64 {
+	switch f := r.(type) {
+	case interface{ Size() int64 }:
+		return f.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
+// checkOldSum compares the checksum of everything read from oldf with
+// expectedSum. Hashing progress is reported to r, which may be nil.
+func checkOldSum(oldf io.Reader, alg checksum.Algorithm, expectedSum []byte, cpBuf []byte, r *progress.Reporter) error {
+	sum, err := alg.New()
+	if err != nil {
+		return &UnsupportedError{err}
+	}
+	if err := r.Start(progress.Hashing, sizeOf(oldf)); err != nil {
+		return err
+	}
+	sumw := &writeCounter{w: sum, progress: r}
+	if _, err := io.CopyBuffer(sumw, ioReader{oldf, "read oldfile"}, cpBuf); err != nil {
+		return err
+	}
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	actualSum := sum.Sum(nil)
+	if !bytes.Equal(expectedSum, actualSum) {
+		return &ChecksumError{File: "oldfile", Algorithm: alg, Expected: expectedSum, Actual: actualSum}
+	}
+	return nil
+}
+
+// oldFile is the old file of patchStream, which the checks of its checksum
+// read from the start
+type oldFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// deferredOldSum verifies the old file checksum concurrently while the patch
+// is applied
+type deferredOldSum struct {
+	result chan error
+	// quit stops the check, done is set once it has ended
+	quit chan struct{}
+	done bool
+}
+
+func startOldSum(oldf io.ReaderAt, alg checksum.Algorithm, expectedSum []byte, bufSize int) *deferredOldSum {
+	d := &deferredOldSum{result: make(chan error, 1), quit: make(chan struct{})}
+	go func() {
+		oldr := &quitReader{io.NewSectionReader(oldf, 0, math.MaxInt64), d.quit}
+		d.result <- checkOldSum(oldr, alg, expectedSum, make([]byte, bufSize), nil)
+	}()
+	return d
+}
+
+// wait returns the result of the check. The check is not reported to a
+// progress.Reporter, it would interleave with the Applying phase.
+func (d *deferredOldSum) wait() error {
+	d.done = true
+	return <-d.result
+}
+
+// stop ends a check that wait has not collected and waits for it, so the old
+// file is no longer read once patching returns. d may be nil.
+func (d *deferredOldSum) stop() {
+	if d == nil || d.done {
+		return
+	}
+	d.done = true
+	close(d.quit)
+	<-d.result
+}
+
+// quitReader reads from r until quit is closed
+type quitReader struct {
+	r    io.Reader
+	quit <-chan struct{}
+}
+
+func (q *quitReader) Read(p []byte) (int, error) {
+	select {
+	case <-q.quit:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return q.r.Read(p)
+}
+
+// newSumWriter hashes the new file as it is written, once per algorithm
+type newSumWriter struct {
+	hashes   map[checksum.Algorithm]hash.Hash
+	expected []expectedSum
+}
+
+type expectedSum struct {
+	alg checksum.Algorithm
+	sum []byte
+}
+
+func newNewSumWriter(expected ...expectedSum) (*newSumWriter, error) {
+	w := &newSumWriter{hashes: map[checksum.Algorithm]hash.Hash{}}
+	for _, e := range expected {
+		if e.sum == nil || e.alg == checksum.None {
+			continue
+		}
+		if _, ok := w.hashes[e.alg]; !ok {
+			h, err := e.alg.New()
+			if err != nil {
+				return nil, &UnsupportedError{err}
+			}
+			w.hashes[e.alg] = h
+		}
+		w.expected = append(w.expected, e)
+	}
+	if len(w.expected) == 0 {
+		return nil, nil
+	}
+	return w, nil
+}
+
+func (w *newSumWriter) Write(p []byte) (int, error) {
+	for _, h := range w.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify compares the written data with the expected checksums
+func (w *newSumWriter) verify() error {
+	for _, e := range w.expected {
+		actualSum := w.hashes[e.alg].Sum(nil)
+		if !bytes.Equal(e.sum, actualSum) {
+			return &ChecksumError{File: "newfile", Algorithm: e.alg, Expected: e.sum, Actual: actualSum}
+		}
+	}
+	return nil
+}
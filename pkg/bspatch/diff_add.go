@@ -0,0 +1,84 @@
+package bspatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnequalReads was returned when the old file and the diff block returned
+// reads of different lengths.
+//
+// Deprecated: short reads are retried and no longer fail.
+var ErrUnequalReads = errors.New("byteAdder.Read: did not read equal number of bytes from both readers")
+
+// highBits has the top bit of every byte of a word set
+const highBits = 0x8080808080808080
+
+// addBytes adds src to dst bytewise, eight bytes at a time. The low seven
+// bits of every byte are added without carrying into the next byte, the top
+// bits are added without carry by xor. len(src) must be at least len(dst).
+func addBytes(dst, src []byte) {
+	src = src[:len(dst)]
+	i := 0
+	for ; i+8 <= len(dst); i += 8 {
+		a := binary.LittleEndian.Uint64(dst[i:])
+		b := binary.LittleEndian.Uint64(src[i:])
+		binary.LittleEndian.PutUint64(dst[i:], ((a&^highBits)+(b&^highBits))^((a^b)&highBits))
+	}
+	for ; i < len(dst); i++ {
+		dst[i] += src[i]
+	}
+}
+
+// oldPastEndError reports diff bytes at the newfile offset that have no old
+// file bytes to be added to
+func oldPastEndError(offset int64) error {
+	return newCorruptPatchError(fmt.Sprintf("diff at newfile offset %v reads past the end of the oldfile", offset))
+}
+
+// copyDiff writes n bytes of the diff block added to the old file to newf,
+// using diffBuf and oldBuf of equal size. offset is the position in the new
+// file, for errors.
+func copyDiff(newf io.Writer, data, oldf io.Reader, n, offset int64, diffBuf, oldBuf []byte) error {
+	for done := int64(0); done < n; {
+		k := len(diffBuf)
+		if int64(k) > n-done {
+			k = int(n - done)
+		}
+		if m, err := io.ReadFull(data, diffBuf[:k]); m < k {
+			return blockReadError("diff", offset, done+int64(m), n, err)
+		}
+		if m, err := io.ReadFull(oldf, oldBuf[:k]); m < k {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return oldPastEndError(offset + done + int64(m))
+			}
+			return err
+		}
+		addBytes(diffBuf[:k], oldBuf[:k])
+		if _, err := newf.Write(diffBuf[:k]); err != nil {
+			return err
+		}
+		done += int64(k)
+	}
+	return nil
+}
+
+// copyExtra writes n bytes of the extra block to newf through buf
+func copyExtra(newf io.Writer, xtra io.Reader, n, offset int64, buf []byte) error {
+	for done := int64(0); done < n; {
+		k := len(buf)
+		if int64(k) > n-done {
+			k = int(n - done)
+		}
+		if m, err := io.ReadFull(xtra, buf[:k]); m < k {
+			return blockReadError("extra", offset, done+int64(m), n, err)
+		}
+		if _, err := newf.Write(buf[:k]); err != nil {
+			return err
+		}
+		done += int64(k)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package bspatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+)
+
+// Sentinel errors for errors.Is. Every error returned while patching, other
+// than the error of a cancelled context, matches at most one of the categories
+// ErrCorruptPatch, ErrChecksumMismatch, ErrCodec, ErrUnsupported, ErrLimit
+// and ErrIO;
+// the more specific sentinels also match ErrCorruptPatch.
+var (
+	// ErrCorruptPatch means the patch is damaged; a fresh download may help
+	ErrCorruptPatch = errors.New("corrupt patch")
+	// ErrTruncated means a block of the patch ended early
+	ErrTruncated = errors.New("truncated patch")
+	// ErrBadMagic means the data is not a patch in a known format
+	ErrBadMagic = errors.New("incorrect magic number")
+	// ErrControlOverflow means a control triple points outside the new file
+	ErrControlOverflow = errors.New("control data exceeds new file")
+	// ErrChecksumMismatch means the old or new file does not match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrCodec means a block could not be decompressed
+	ErrCodec = errors.New("codec failure")
+	// ErrUnsupported means the patch needs features this version lacks
+	ErrUnsupported = errors.New("unsupported patch")
+	// ErrIO means reading the old file or writing the new file failed
+	ErrIO = errors.New("i/o error")
+	// ErrLimit means the patch exceeds a limit set with an Option
+	ErrLimit = errors.New("limit exceeded")
+)
+
+// CorruptPatchError is returned for inconsistent patch headers
+type CorruptPatchError struct {
+	Name string
+}
+
+func newCorruptPatchError(e string) CorruptPatchError {
+	return CorruptPatchError{"corrupt patch: " + e}
+}
+
+func (e CorruptPatchError) Error() string {
+	return e.Name
+}
+
+// Is makes CorruptPatchError match ErrCorruptPatch
+func (e CorruptPatchError) Is(target error) bool {
+	return target == ErrCorruptPatch
+}
+
+// BadMagicError is returned when the patch starts with an unknown magic number
+type BadMagicError struct {
+	Magic []byte
+}
+
+func (e *BadMagicError) Error() string {
+	return fmt.Sprintf("corrupt patch: incorrect magic number %q (header BSDIFF40, BSDIFFEX or ENDSLEY/BSDIFF43)", e.Magic)
+}
+
+// Is makes BadMagicError match ErrBadMagic and ErrCorruptPatch
+func (e *BadMagicError) Is(target error) bool {
+	return target == ErrBadMagic || target == ErrCorruptPatch
+}
+
+// TruncatedBlockError is returned when a block of the patch ends before the
+// control data says it should
+type TruncatedBlockError struct {
+	// Block is "header", "control", "diff" or "extra"
+	Block string
+	// Offset is the position in the new file being written
+	Offset int64
+	// Read and Expected are the number of bytes read and wanted from the block
+	Read     int64
+	Expected int64
+	// Err is the upstream error, if any
+	Err error
+}
+
+func (e *TruncatedBlockError) Error() string {
+	return fmt.Sprintf("corrupt patch or stream ended: %s block read (%v/%v) at newfile offset %v, upstream error: %v", e.Block, e.Read, e.Expected, e.Offset, e.Err)
+}
+
+// Is makes TruncatedBlockError match ErrTruncated and ErrCorruptPatch
+func (e *TruncatedBlockError) Is(target error) bool {
+	return target == ErrTruncated || target == ErrCorruptPatch
+}
+
+// Unwrap returns the upstream error
+func (e *TruncatedBlockError) Unwrap() error {
+	return e.Err
+}
+
+// ControlOverflowError is returned when a control triple would write past
+// the size of the new file recorded in the header
+type ControlOverflowError struct {
+	// Block is "diff" or "extra"
+	Block   string
+	Offset  int64
+	Length  int64
+	NewSize int64
+}
+
+func (e *ControlOverflowError) Error() string {
+	return fmt.Sprintf("corrupt patch: newfile pos %v + %s block length %v exceeds expected newfile size %v", e.Offset, e.Block, e.Length, e.NewSize)
+}
+
+// Is makes ControlOverflowError match ErrControlOverflow and ErrCorruptPatch
+func (e *ControlOverflowError) Is(target error) bool {
+	return target == ErrControlOverflow || target == ErrCorruptPatch
+}
+
+// ChecksumError is returned when a file does not match the checksum recorded
+// in the patch or passed by the caller
+type ChecksumError struct {
+	// File is "oldfile" or "newfile"
+	File      string
+	Algorithm checksum.Algorithm
+	Expected  []byte
+	Actual    []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("invalid %s %v checksum: expected % x, but got % x", e.File, e.Algorithm, e.Expected, e.Actual)
+}
+
+// Is makes ChecksumError match ErrChecksumMismatch
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// CodecError is returned when a codec fails to decompress a block, or the
+// patch names a codec that is not registered
+type CodecError struct {
+	Codec string
+	Block string
+	Err   error
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("codec %s failed on %s block: %v", e.Codec, e.Block, e.Err)
+}
+
+// Is makes CodecError match ErrCodec
+func (e *CodecError) Is(target error) bool {
+	return target == ErrCodec
+}
+
+// Unwrap returns the codec's error
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedError is returned for patches using a format version, flag,
+// critical extension or hash algorithm this package does not know
+type UnsupportedError struct {
+	Err error
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Err.Error()
+}
+
+// Is makes UnsupportedError match ErrUnsupported
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+// Unwrap returns the underlying error
+func (e *UnsupportedError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError is returned when a patch exceeds a limit set with an Option,
+// for example WithMaxNewSize
+type LimitError struct {
+	What  string
+	Value int64
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s %v exceeds the limit of %v", e.What, e.Value, e.Limit)
+}
+
+// Is makes LimitError match ErrLimit
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimit
+}
+
+// IOError is returned when reading the old file or writing the new file fails
+type IOError struct {
+	Op  string
+	Err error
+}
+
+func (e *IOError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Is makes IOError match ErrIO
+func (e *IOError) Is(target error) bool {
+	return target == ErrIO
+}
+
+// Unwrap returns the underlying error
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// blockReadError classifies the error of reading n of expected bytes from a
+// block: codec, I/O and context errors are passed on, anything else is a
+// truncation.
+func blockReadError(block string, offset, n, expected int64, err error) error {
+	var cerr *CodecError
+	var ioerr *IOError
+	if errors.As(err, &cerr) || errors.As(err, &ioerr) || err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &TruncatedBlockError{Block: block, Offset: offset, Read: n, Expected: expected, Err: err}
+}
+
+// codecReader marks errors of a decompressor as codec errors. End of stream
+// errors are passed through since the caller knows how much it expects.
+type codecReader struct {
+	r     io.Reader
+	codec string
+	block string
+}
+
+func (r *codecReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		var ioerr *IOError
+		if !errors.As(err, &ioerr) {
+			err = &CodecError{Codec: r.codec, Block: r.block, Err: err}
+		}
+	}
+	return n, err
+}
+
+// ioReader and ioWriter mark errors of the old and new file as I/O errors
+type ioReader struct {
+	r  io.Reader
+	op string
+}
+
+func (r ioReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &IOError{Op: r.op, Err: err}
+	}
+	return n, err
+}
+
+type ioWriter struct {
+	w  io.Writer
+	op string
+}
+
+func (w ioWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		err = &IOError{Op: w.op, Err: err}
+	}
+	return n, err
+}
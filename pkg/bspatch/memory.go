@@ -0,0 +1,147 @@
+package bspatch
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/container"
+)
+
+// headerInfo is what the header of a patch tells about the memory needed to
+// apply it
+type headerInfo struct {
+	newsize int64
+	// codecs holds the codec of every stream
+	codecs []codec.Codec
+}
+
+// parseHeader reads the new file size and the codecs from the header of a
+// patch like openPatch, without opening the blocks
+func parseHeader(head []byte) (*headerInfo, error) {
+	bz2 := codec.Bzip2{}
+	var h headerInfo
+	switch {
+	case bytes.HasPrefix(head, []byte(magicBSDIFF43)):
+		if len(head) < 24 {
+			return nil, shortHeaderError(len(head), 24)
+		}
+		h.newsize, h.codecs = offtin(head[16:]), []codec.Codec{bz2}
+	case bytes.HasPrefix(head, []byte(magicBSDIFF40)):
+		if len(head) < 32 {
+			return nil, shortHeaderError(len(head), 32)
+		}
+		h.newsize, h.codecs = offtin(head[24:]), []codec.Codec{bz2, bz2, bz2}
+	case bytes.HasPrefix(head, []byte(container.Magic)):
+		ch, err := parseExtended(head)
+		if err != nil {
+			return nil, err
+		}
+		codecs, err := extendedCodecs(ch)
+		if err != nil {
+			return nil, err
+		}
+		h.newsize, h.codecs = ch.NewSize, codecs[:]
+	default:
+		if len(head) < len(magicBSDIFF40) {
+			return nil, shortHeaderError(len(head), 32)
+		}
+		return nil, &BadMagicError{Magic: append([]byte{}, head[:len(magicBSDIFF40)]...)}
+	}
+	if h.newsize < 0 {
+		return nil, newCorruptPatchError("negative newsize read from header")
+	}
+	return &h, nil
+}
+
+// EstimateMemory returns about how much memory applying a patch that starts
+// with header needs with opts, not counting the old file, the patch and the
+// new file; Bytes also holds a new file of the size in the header. header
+// must hold the first 74 bytes of the patch, or all of a shorter patch, and
+// the whole header of a BSDIFFEX patch. With WithMaxMemory it is the estimate
+// of the settings patching falls back to, or a *LimitError if none fits.
+func EstimateMemory(header []byte, opts ...Option) (int64, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return 0, err
+	}
+	h, err := parseHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	_, need, err := c.fitMemory(h, false)
+	return need, err
+}
+
+// limitMemory fits c to c.maxMemory for patch. newInMemory is set when the
+// new file is held in memory.
+func limitMemory(patch io.ReaderAt, patchSize int64, c *config, newInMemory bool) (*config, error) {
+	if c.maxMemory <= 0 {
+		return c, nil
+	}
+	head, err := readPatch(patch, patchSize, 0, headLen)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(head, []byte(container.Magic)) {
+		if n, err := container.HeaderLen(head); err == nil && n > len(head) {
+			if head, err = readPatch(patch, patchSize, 0, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	h, err := parseHeader(head)
+	if err != nil {
+		return nil, err
+	}
+	c, _, err = c.fitMemory(h, newInMemory)
+	return c, err
+}
+
+// fitMemory returns c, or a copy of c with cheaper settings, and its
+// estimate for a patch that fits in c.maxMemory: the blocks are not read
+// ahead, and then WriterAt uses a single worker
+func (c *config) fitMemory(h *headerInfo, newInMemory bool) (*config, int64, error) {
+	need := c.memory(h, newInMemory)
+	if c.maxMemory <= 0 || need <= c.maxMemory {
+		return c, need, nil
+	}
+	fc := *c
+	if fc.readAheadSize > 0 {
+		fc.readAheadSize = 0
+		if need = fc.memory(h, newInMemory); need <= c.maxMemory {
+			return &fc, need, nil
+		}
+	}
+	if fc.parallel && fc.workers > 1 {
+		fc.workers = 1
+		if need = fc.memory(h, newInMemory); need <= c.maxMemory {
+			return &fc, need, nil
+		}
+	}
+	return nil, need, &LimitError{What: "memory", Value: need, Limit: c.maxMemory}
+}
+
+// memory estimates the memory of applying a patch with c
+func (c *config) memory(h *headerInfo, newInMemory bool) int64 {
+	m := int64(len(h.codecs)) * blockBufferSize
+	for _, cd := range h.codecs {
+		m += codec.ReaderMemory(cd)
+	}
+	if c.readAheadSize > 0 && h.newsize > 0 {
+		m += int64(c.readAheadSize)
+	}
+	if c.parallel {
+		// the copy buffer, a scratch buffer per worker and 2*workers pieces
+		m += int64(1+3*c.workers) * int64(c.copyBufferSize)
+	} else {
+		m += 2*int64(c.copyBufferSize) + int64(c.writeBufferSize)
+	}
+	if c.oldHashCheck == CheckOldHashDeferred {
+		m += int64(c.copyBufferSize)
+	}
+	if newInMemory {
+		m += h.newsize
+	}
+	return m
+}
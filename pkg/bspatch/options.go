@@ -0,0 +1,161 @@
+package bspatch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// OldHashCheck selects when the old file checksum recorded in a patch is verified
+type OldHashCheck int
+
+const (
+	// CheckOldHashBefore verifies the old file before anything is written.
+	// It reads the old file twice.
+	CheckOldHashBefore OldHashCheck = iota
+	// CheckOldHashDeferred verifies the old file concurrently while the patch
+	// is applied. Patching fails after the new file has been written.
+	CheckOldHashDeferred
+	// CheckOldHashSkip does not verify the old file; for trusted pipelines only
+	CheckOldHashSkip
+)
+
+// Option configures how a patch is applied
+type Option func(*config)
+
+type config struct {
+	expectedNewSum []byte
+	oldHashCheck   OldHashCheck
+	progress       progress.Func
+
+	writeBufferSize int
+	copyBufferSize  int
+	maxNewSize      int64
+	readAheadSize   int
+
+	parallel bool
+	workers  int
+
+	maxMemory int64
+}
+
+// Default buffer sizes for streaming
+const (
+	defaultWriteBufferSize = 1024 * 1024
+	defaultCopyBufferSize  = 1024 * 1024
+	defaultReadAheadSize   = 3 * 1024 * 1024
+)
+
+func newConfig(opts []Option) (*config, error) {
+	c := &config{
+		writeBufferSize: defaultWriteBufferSize,
+		copyBufferSize:  defaultCopyBufferSize,
+		readAheadSize:   defaultReadAheadSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.writeBufferSize < 1 || c.copyBufferSize < 1 {
+		return nil, fmt.Errorf("invalid buffer sizes (write %v copy %v)", c.writeBufferSize, c.copyBufferSize)
+	}
+	if c.workers < 0 {
+		return nil, fmt.Errorf("invalid number of workers %v", c.workers)
+	}
+	if c.workers == 0 {
+		c.workers = runtime.GOMAXPROCS(0)
+	}
+	if c.maxMemory < 0 {
+		return nil, fmt.Errorf("invalid memory limit %v", c.maxMemory)
+	}
+	if c.readAheadSize < 0 {
+		return nil, fmt.Errorf("invalid read ahead size %v", c.readAheadSize)
+	}
+	if c.oldHashCheck < CheckOldHashBefore || c.oldHashCheck > CheckOldHashSkip {
+		return nil, fmt.Errorf("unknown old hash check %v", c.oldHashCheck)
+	}
+	return c, nil
+}
+
+// WithExpectedHash makes patching fail with a *ChecksumError unless the
+// sha256sum of the new file is sum. It is checked in addition to any new file
+// checksum recorded in the patch.
+func WithExpectedHash(sum [sha256.Size]byte) Option {
+	return func(c *config) {
+		c.expectedNewSum = sum[:]
+	}
+}
+
+// WithOldHashCheck selects when the old file checksum is verified. The
+// default is CheckOldHashBefore.
+func WithOldHashCheck(mode OldHashCheck) Option {
+	return func(c *config) {
+		c.oldHashCheck = mode
+	}
+}
+
+// WithProgress calls fn as the patch is applied with the phase
+// (progress.Hashing or Applying) and the bytes done out of the total of that
+// phase
+func WithProgress(fn progress.Func) Option {
+	return func(c *config) {
+		c.progress = fn
+	}
+}
+
+// WithWriteBufferSize sets the size of the buffer in front of the new file.
+// The default is 1 MiB.
+func WithWriteBufferSize(n int) Option {
+	return func(c *config) {
+		c.writeBufferSize = n
+	}
+}
+
+// WithCopyBufferSize sets the size of the buffer used to copy the diff and
+// extra data and to hash the old file. The default is 1 MiB.
+func WithCopyBufferSize(n int) Option {
+	return func(c *config) {
+		c.copyBufferSize = n
+	}
+}
+
+// WithMaxNewSize makes patching fail with a *LimitError before anything is
+// written when the patch would create a new file larger than n bytes
+func WithMaxNewSize(n int64) Option {
+	return func(c *config) {
+		c.maxNewSize = n
+	}
+}
+
+// WithReadAheadSize bounds the decompressed patch data buffered ahead of the
+// new file. The control, diff and extra blocks are decompressed concurrently,
+// each on its own goroutine into an equal share of n bytes. The default is
+// 3 MiB; 0 decompresses the blocks on the patching goroutine as they are
+// needed.
+func WithReadAheadSize(n int) Option {
+	return func(c *config) {
+		c.readAheadSize = n
+	}
+}
+
+// WithParallel makes File apply patches like WriterAt, on workers goroutines,
+// or GOMAXPROCS goroutines if workers is 0. It also sets the number of
+// goroutines of WriterAt. The new file is the same as without WithParallel.
+func WithParallel(workers int) Option {
+	return func(c *config) {
+		c.parallel = true
+		c.workers = workers
+	}
+}
+
+// WithMaxMemory limits the memory of patching, besides the old file, the
+// patch and the new file, to about n bytes (see EstimateMemory); for Bytes it
+// includes the new file. A patch that would need more is applied without
+// read ahead and, if that is not enough, with a single worker. If it still
+// needs more patching fails with a *LimitError before anything is written.
+func WithMaxMemory(n int64) Option {
+	return func(c *config) {
+		c.maxMemory = n
+	}
+}
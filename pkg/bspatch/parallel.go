@@ -0,0 +1,225 @@
+package bspatch
+
+import (
+	"io"
+	"sync"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// piece is a part of the new file of up to copyBufferSize bytes. buf holds
+// the diff and extra bytes in new file order; the old file bytes of the spans
+// are added to it before it is written at newpos.
+type piece struct {
+	newpos int64
+	buf    []byte
+	spans  []oldSpan
+	err    error
+	done   chan struct{}
+}
+
+// oldSpan is a run of diff bytes in a piece that the old file bytes at oldpos
+// are added to
+type oldSpan struct {
+	off, n int
+	oldpos int64
+}
+
+// apply adds the old file bytes to the piece and writes it to newf. scratch
+// holds at least len(p.buf) bytes.
+func (p *piece) apply(oldf io.ReaderAt, newf io.WriterAt, scratch []byte) error {
+	for _, s := range p.spans {
+		old := scratch[:s.n]
+		if n, err := oldf.ReadAt(old, s.oldpos); n < len(old) {
+			if err == io.EOF {
+				return oldPastEndError(p.newpos + int64(s.off) + int64(n))
+			}
+			return &IOError{"read oldfile", err}
+		}
+		addBytes(p.buf[s.off:s.off+s.n], old)
+	}
+	if _, err := newf.WriteAt(p.buf, p.newpos); err != nil {
+		return &IOError{"write newfile", err}
+	}
+	return nil
+}
+
+// patchAt applies patch to newf on c.workers goroutines. The calling
+// goroutine decodes the control block and reads the diff and extra bytes into
+// pieces, which the workers complete and write in any order. Another
+// goroutine waits for the pieces in order to hash and report them.
+func patchAt(oldf io.ReaderAt, newf io.WriterAt, patch io.ReaderAt, patchSize int64, c *config, r *progress.Reporter) error {
+	c, err := limitMemory(patch, patchSize, c, false)
+	if err != nil {
+		return err
+	}
+	cpBuf := make([]byte, c.copyBufferSize)
+	pr, oldSum, newSum, err := beginPatch(oldSectionReader(oldf), patch, patchSize, c, cpBuf, r)
+	if err != nil {
+		return err
+	}
+	// stops the read ahead goroutines and the old file check when patching
+	// fails
+	defer pr.Close()
+	defer oldSum.stop()
+
+	// at most 2*workers pieces are in flight, each with a buffer of its own
+	window := 2 * c.workers
+	free := make(chan []byte, window)
+	for i := 0; i < window; i++ {
+		free <- nil
+	}
+	queue := make(chan *piece, window)
+	jobs := make(chan *piece)
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scratch := make([]byte, c.copyBufferSize)
+			for p := range jobs {
+				p.err = p.apply(oldf, newf, scratch)
+				close(p.done)
+			}
+		}()
+	}
+
+	collected := make(chan error, 1)
+	go func() {
+		var err error
+		var written int64
+		for p := range queue {
+			<-p.done
+			if err == nil {
+				err = p.err
+				if err == nil && newSum != nil {
+					newSum.Write(p.buf)
+				}
+				if err == nil {
+					written += int64(len(p.buf))
+					err = r.Update(written)
+				}
+				if err != nil {
+					close(quit)
+				}
+			}
+			free <- p.buf
+		}
+		collected <- err
+	}()
+
+	err = splitPieces(pr, c.copyBufferSize, free, queue, jobs, quit)
+	close(jobs)
+	close(queue)
+	wg.Wait()
+	if cerr := <-collected; err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return endPatch(pr, oldSum, newSum, r)
+}
+
+// splitPieces reads the patch into pieces of up to pieceSize bytes and hands
+// them to the workers and, in order, to the queue. Buffers for the pieces are
+// taken from free. It returns early without an error once quit is closed.
+func splitPieces(pr *patchReader, pieceSize int, free chan []byte, queue, jobs chan *piece, quit chan struct{}) error {
+	var newpos, oldpos int64
+	var ctrip ctrlTriple
+	hdbuf := make([]byte, 8)
+	newsize := pr.newsize
+
+	var p *piece
+	// grow makes sure there is a piece with room for more bytes
+	grow := func() bool {
+		if p != nil {
+			return true
+		}
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-quit:
+			return false
+		}
+		if buf == nil {
+			buf = make([]byte, 0, pieceSize)
+		}
+		p = &piece{newpos: newpos, buf: buf[:0], done: make(chan struct{})}
+		return true
+	}
+	send := func() {
+		queue <- p
+		jobs <- p
+		p = nil
+	}
+	// read appends n bytes of block to the pieces, adding a span for the diff
+	// bytes
+	read := func(block string, r io.Reader, n int64, diff bool) (bool, error) {
+		offset := newpos
+		for n > 0 {
+			if !grow() {
+				return false, nil
+			}
+			k := cap(p.buf) - len(p.buf)
+			if int64(k) > n {
+				k = int(n)
+			}
+			start := len(p.buf)
+			p.buf = p.buf[:start+k]
+			if m, err := io.ReadFull(r, p.buf[start:]); m < k {
+				return false, blockReadError(block, offset, newpos-offset+int64(m), newpos-offset+n, err)
+			}
+			if diff {
+				p.spans = append(p.spans, oldSpan{off: start, n: k, oldpos: oldpos})
+				oldpos += int64(k)
+			}
+			newpos += int64(k)
+			n -= int64(k)
+			if len(p.buf) == cap(p.buf) {
+				send()
+			}
+		}
+		return true, nil
+	}
+
+	for newpos < newsize {
+		// Read control data
+		for i := 0; i < 3; i++ {
+			lenread, err := io.ReadFull(pr.ctrl, hdbuf)
+			if lenread != 8 || (err != nil && err != io.EOF) {
+				return blockReadError("control", newpos, int64(lenread), 8, err)
+			}
+			ctrip[i] = offtin(hdbuf)
+		}
+		if err := ctrip.checkLengths(newpos); err != nil {
+			return err
+		}
+
+		if ctrip.sum() > newsize-newpos {
+			return &ControlOverflowError{Block: "diff", Offset: newpos, Length: ctrip.sum(), NewSize: newsize}
+		}
+		if ok, err := read("diff", pr.data, ctrip.sum(), true); !ok {
+			return err
+		}
+
+		if ctrip.copy() > newsize-newpos {
+			return &ControlOverflowError{Block: "extra", Offset: newpos, Length: ctrip.copy(), NewSize: newsize}
+		}
+		if ok, err := read("extra", pr.xtra, ctrip.copy(), false); !ok {
+			return err
+		}
+
+		// Adjust oldfile offset by ctrl triple
+		oldpos += ctrip.seek()
+		if oldpos < 0 {
+			return seekError(newpos, oldpos)
+		}
+	}
+	if p != nil {
+		send()
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package bspatch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kiteco/go-bsdiff/pkg/checksum"
+	"github.com/kiteco/go-bsdiff/pkg/codec"
+	"github.com/kiteco/go-bsdiff/pkg/container"
+)
+
+const (
+	magicBSDIFF40 = "BSDIFF40"
+	magicBSDIFF43 = "ENDSLEY/BSDIFF43"
+)
+
+// patchReader holds the decompressed control, diff and extra streams of a patch.
+// For single stream formats all three read from the same stream.
+type patchReader struct {
+	newsize int64
+	// oldSum and newSum are the checksums of the old and new file, if the
+	// patch records them
+	oldHash checksum.Algorithm
+	oldSum  []byte
+	newHash checksum.Algorithm
+	newSum  []byte
+	ctrl    io.Reader
+	data    io.Reader
+	xtra    io.Reader
+	closers []io.Closer
+	// rings read the streams ahead, see readAhead
+	rings []*ringBuffer
+}
+
+// headLen is how much of a patch is read to tell the formats apart: the
+// BSDIFF40 header with the old file checksum and the start of a bzip2 stream
+const headLen = 64 + 10
+
+// blockBufferSize is the size of the buffer between a block of the patch and
+// its decompressor
+const blockBufferSize = 64 * 1024
+
+// openPatch parses the header of the size bytes long patch and opens the
+// block readers. Only the header is held in memory.
+func openPatch(patch io.ReaderAt, size int64) (*patchReader, error) {
+	head, err := readPatch(patch, size, 0, headLen)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte(magicBSDIFF43)):
+		return openBsdiff43(patch, size, head)
+	case bytes.HasPrefix(head, []byte(magicBSDIFF40)):
+		return openBsdiff40(patch, size, head)
+	case bytes.HasPrefix(head, []byte(container.Magic)):
+		return openExtended(patch, size, head)
+	}
+	if len(head) < len(magicBSDIFF40) {
+		return nil, shortHeaderError(len(head), 32)
+	}
+	return nil, &BadMagicError{Magic: append([]byte{}, head[:len(magicBSDIFF40)]...)}
+}
+
+// readPatch reads up to n bytes at off, fewer at the end of the patch
+func readPatch(patch io.ReaderAt, size, off int64, n int) ([]byte, error) {
+	if rest := size - off; rest < int64(n) {
+		n = int(rest)
+	}
+	if n < 0 {
+		n = 0
+	}
+	b := make([]byte, n)
+	if m, err := patch.ReadAt(b, off); m < n {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &IOError{"read patch", err}
+	}
+	return b, nil
+}
+
+// shortHeaderError reports a patch shorter than its header
+func shortHeaderError(n int, expected int64) error {
+	return &TruncatedBlockError{Block: "header", Read: int64(n), Expected: expected, Err: io.ErrUnexpectedEOF}
+}
+
+func openBsdiff40(patch io.ReaderAt, size int64, head []byte) (*patchReader, error) {
+	// File format:
+	// --- header ---
+	//  0     -  7       : "BSDIFF40"
+	//  8     - 15       : X
+	// 16     - 23       : Y
+	// 24     - 31       : len(newfile)
+	// 32     - 63       : sha256sum(oldfile)
+	// ---  data  ---
+	// 64     - 64+X-1   : bzip2(control block)
+	// 64+X   - 64+X+Y-1 : bzip2(diff block)
+	// 64+X+Y - ??       : bzip2(extra block)
+	//
+	// Classic (upstream) patches have no checksum and the data starts at 32.
+
+	const classicHeaderLen int64 = 32
+
+	if int64(len(head)) < classicHeaderLen {
+		return nil, shortHeaderError(len(head), classicHeaderLen)
+	}
+
+	// Classic patches start the bzip2 control block right after the header,
+	// ours put the old file checksum in between
+	headerLen := classicHeaderLen
+	var oldSum []byte
+	if !isBzip2Stream(head[classicHeaderLen:]) {
+		headerLen = classicHeaderLen + sha256.Size
+		if int64(len(head)) < headerLen {
+			return nil, shortHeaderError(len(head), headerLen)
+		}
+		oldSum = head[classicHeaderLen:headerLen]
+	}
+
+	header := head[:classicHeaderLen]
+	bz2 := codec.Bzip2{}
+	pr, err := openBlocks(patch, size, headerLen, offtin(header[8:]), offtin(header[16:]), -1, offtin(header[24:]), [3]codec.Codec{bz2, bz2, bz2})
+	if err != nil {
+		return nil, err
+	}
+	if oldSum != nil {
+		pr.oldHash, pr.oldSum = checksum.SHA256, oldSum
+	}
+	return pr, nil
+}
+
+func openExtended(patch io.ReaderAt, size int64, head []byte) (*patchReader, error) {
+	// File format: see package container
+
+	// the extensions may not fit in head
+	if n, err := container.HeaderLen(head); err == nil && n > len(head) {
+		if head, err = readPatch(patch, size, 0, n); err != nil {
+			return nil, err
+		}
+	}
+	h, err := parseExtended(head)
+	if err != nil {
+		return nil, err
+	}
+	codecs, err := extendedCodecs(h)
+	if err != nil {
+		return nil, err
+	}
+
+	oldHash, oldSum, err := hashExtension(h, container.ExtOldHash)
+	if err != nil {
+		return nil, err
+	}
+	newHash, newSum, err := hashExtension(h, container.ExtNewHash)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := openBlocks(patch, size, int64(h.Len()), h.CtrlLen, h.DiffLen, h.ExtraLen, h.NewSize, codecs)
+	if err != nil {
+		return nil, err
+	}
+	pr.oldHash, pr.oldSum = oldHash, oldSum
+	pr.newHash, pr.newSum = newHash, newSum
+	return pr, nil
+}
+
+// parseExtended parses the header of a FormatExtended patch
+func parseExtended(head []byte) (*container.Header, error) {
+	h, err := container.ParseHeader(head)
+	if err != nil {
+		var uerr *container.UnsupportedError
+		switch {
+		case errors.As(err, &uerr):
+			return nil, &UnsupportedError{err}
+		case err == container.ErrShortHeader:
+			n, _ := container.HeaderLen(head)
+			if n < container.FixedLen {
+				n = container.FixedLen
+			}
+			return nil, shortHeaderError(len(head), int64(n))
+		}
+		return nil, newCorruptPatchError(err.Error())
+	}
+	return h, nil
+}
+
+// extendedCodecs returns the codecs of the blocks, bzip2 unless recorded
+func extendedCodecs(h *container.Header) ([3]codec.Codec, error) {
+	bz2 := codec.Bzip2{}
+	codecs := [3]codec.Codec{bz2, bz2, bz2}
+	if ids, ok := h.Extension(container.ExtCodecs); ok {
+		if len(ids) != 3 {
+			return codecs, newCorruptPatchError(fmt.Sprintf("codec extension of %v bytes", len(ids)))
+		}
+		return lookupCodecs(ids)
+	}
+	return codecs, nil
+}
+
+// hashExtension decodes the algorithm and digest of a hash extension
+func hashExtension(h *container.Header, t container.ExtType) (checksum.Algorithm, []byte, error) {
+	v, ok := h.Extension(t)
+	if !ok || len(v) == 0 {
+		return checksum.None, nil, nil
+	}
+	alg := checksum.Algorithm(v[0])
+	if size := alg.Size(); size < 0 || len(v)-1 != size {
+		return checksum.None, nil, &UnsupportedError{fmt.Errorf("unsupported hash extension %#04x (% x)", uint16(t), v)}
+	}
+	if alg == checksum.None {
+		return checksum.None, nil, nil
+	}
+	return alg, v[1:], nil
+}
+
+var blockNames = [3]string{"control", "diff", "extra"}
+
+func lookupCodecs(ids []byte) ([3]codec.Codec, error) {
+	var codecs [3]codec.Codec
+	for i := range codecs {
+		c, err := codec.Lookup(codec.ID(ids[i]))
+		if err != nil {
+			return codecs, &CodecError{Codec: fmt.Sprintf("id %d", ids[i]), Block: blockNames[i], Err: err}
+		}
+		codecs[i] = c
+	}
+	return codecs, nil
+}
+
+// openBlocks opens the control, diff and extra blocks of a three block patch
+// whose header is headerLen bytes long. A negative bzxtralen means the extra
+// block runs to the end of the patch.
+func openBlocks(patch io.ReaderAt, size, headerLen, bzctrllen, bzdatalen, bzxtralen, newsize int64, codecs [3]codec.Codec) (*patchReader, error) {
+	if bzctrllen < 0 || bzdatalen < 0 || newsize < 0 {
+		errmsg := fmt.Sprintf("negative length block(s) read from header (bzctrllen %v bzdatalen %v newsize %v)", bzctrllen, bzdatalen, newsize)
+		return nil, newCorruptPatchError(errmsg)
+	}
+	if bzxtralen < 0 {
+		bzxtralen = size - headerLen - bzctrllen - bzdatalen
+	}
+	if bzxtralen < 0 || headerLen+bzctrllen+bzdatalen+bzxtralen > size {
+		errmsg := fmt.Sprintf("block(s) exceed patch size (bzctrllen %v bzdatalen %v bzxtralen %v patch size %v)", bzctrllen, bzdatalen, bzxtralen, size)
+		return nil, newCorruptPatchError(errmsg)
+	}
+
+	// Re-open the patch via the codecs at the right places
+	pr := &patchReader{newsize: newsize}
+	blocks := []struct {
+		r   *io.Reader
+		off int64
+		n   int64
+	}{
+		{&pr.ctrl, headerLen, bzctrllen},
+		{&pr.data, headerLen + bzctrllen, bzdatalen},
+		{&pr.xtra, headerLen + bzctrllen + bzdatalen, bzxtralen},
+	}
+	for i, b := range blocks {
+		rc, err := codecs[i].NewReader(blockReader(patch, b.off, b.n))
+		if err != nil {
+			pr.Close()
+			return nil, &CodecError{Codec: codecs[i].Name(), Block: blockNames[i], Err: err}
+		}
+		*b.r = &codecReader{r: rc, codec: codecs[i].Name(), block: blockNames[i]}
+		pr.closers = append(pr.closers, rc)
+	}
+	return pr, nil
+}
+
+// blockReader returns a buffered reader of the n bytes of patch at off
+func blockReader(patch io.ReaderAt, off, n int64) io.Reader {
+	return bufio.NewReaderSize(ioReader{io.NewSectionReader(patch, off, n), "read patch"}, blockBufferSize)
+}
+
+func openBsdiff43(patch io.ReaderAt, size int64, head []byte) (*patchReader, error) {
+	// File format:
+	// --- header ---
+	//  0     - 15       : "ENDSLEY/BSDIFF43"
+	// 16     - 23       : len(newfile)
+	// ---  data  ---
+	// 24     - ??       : bzip2(ctrl triple, diff bytes, extra bytes, ...)
+
+	const headerLen = 24
+
+	if len(head) < headerLen {
+		return nil, shortHeaderError(len(head), headerLen)
+	}
+	newsize := offtin(head[16:])
+	if newsize < 0 {
+		errmsg := fmt.Sprintf("negative newsize read from header (newsize %v)", newsize)
+		return nil, newCorruptPatchError(errmsg)
+	}
+	bz2 := codec.Bzip2{}
+	bz, err := bz2.NewReader(blockReader(patch, headerLen, size-headerLen))
+	if err != nil {
+		return nil, &CodecError{Codec: bz2.Name(), Block: "data", Err: err}
+	}
+	// The triples, diff and extra bytes are interleaved in the order the apply
+	// loop consumes them, so one stream serves all three.
+	r := &codecReader{r: bz, codec: bz2.Name(), block: "data"}
+	return &patchReader{
+		newsize: newsize,
+		ctrl:    r,
+		data:    r,
+		xtra:    r,
+		closers: []io.Closer{bz},
+	}, nil
+}
+
+// readAhead decompresses every stream of the patch on a goroutine of its own
+// into a ring buffer, using at most size bytes for all of them
+func (pr *patchReader) readAhead(size int) {
+	streams := []*io.Reader{&pr.ctrl, &pr.data, &pr.xtra}
+	single := pr.ctrl == pr.data
+	if single {
+		streams = streams[:1]
+	}
+	n := size / len(streams)
+	if n < 1 {
+		n = 1
+	}
+	for _, s := range streams {
+		rb := newRingBuffer(*s, n)
+		pr.rings = append(pr.rings, rb)
+		*s = rb
+	}
+	if single {
+		pr.data, pr.xtra = pr.ctrl, pr.ctrl
+	}
+}
+
+// Close stops reading ahead and closes the underlying decompressors
+func (pr *patchReader) Close() error {
+	for _, rb := range pr.rings {
+		rb.Close()
+	}
+	pr.rings = nil
+	var err error
+	for _, c := range pr.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	pr.closers = nil
+	return err
+}
+
+// isBzip2Stream reports whether b starts with a bzip2 stream header followed
+// by either a block header or an end of stream marker
+func isBzip2Stream(b []byte) bool {
+	if len(b) < 10 || string(b[:3]) != "BZh" || b[3] < '1' || b[3] > '9' {
+		return false
+	}
+	magic := b[4:10]
+	return bytes.Equal(magic, []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}) ||
+		bytes.Equal(magic, []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90})
+}
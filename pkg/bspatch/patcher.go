@@ -0,0 +1,195 @@
+package bspatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+	"github.com/kiteco/go-bsdiff/pkg/util"
+)
+
+// Patcher applies patches with a fixed set of options. Its options can not
+// change after NewPatcher, so one Patcher can be used by many goroutines.
+type Patcher struct {
+	c *config
+}
+
+// NewPatcher returns a Patcher for the given options
+func NewPatcher(opts ...Option) (*Patcher, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Patcher{c}, nil
+}
+
+// Bytes applies a patch with the oldfile to create the newfile
+func (p *Patcher) Bytes(ctx context.Context, oldfile, patch []byte) ([]byte, error) {
+	return patchb(oldfile, patch, p.c, p.reporter(ctx))
+}
+
+// Reader applies a patch (using oldbin and patchf) to create the newbin.
+// An oldbin or patchf that is an io.ReaderAt of known size, such as a regular
+// *os.File or a *bytes.Reader, is read as needed from its current offset;
+// other readers, pipes among them, are read into memory first. newbin may
+// have received part of the new file when Reader fails.
+func (p *Patcher) Reader(ctx context.Context, oldbin io.Reader, newbin io.Writer, patchf io.Reader) error {
+	var oldf io.ReaderAt
+	if sr, ok := sectionOf(oldbin); ok {
+		oldf = sr
+	} else {
+		oldbs, err := ioutil.ReadAll(oldbin)
+		if err != nil {
+			return &IOError{"read oldfile", err}
+		}
+		oldf = bytes.NewReader(oldbs)
+	}
+	var patch io.ReaderAt
+	var patchSize int64
+	if sr, ok := sectionOf(patchf); ok {
+		patch, patchSize = sr, sr.Size()
+	} else {
+		patchbs, err := ioutil.ReadAll(patchf)
+		if err != nil {
+			return &IOError{"read patch", err}
+		}
+		patch, patchSize = bytes.NewReader(patchbs), int64(len(patchbs))
+	}
+	return p.Stream(ctx, oldf, newbin, patch, patchSize)
+}
+
+// sectionOf returns the data of r from its current offset to its end, when r
+// can be read at offsets and has a size
+func sectionOf(r io.Reader) (*io.SectionReader, bool) {
+	ra, ok := r.(io.ReaderAt)
+	size := sizeOf(r)
+	if !ok || size < 0 {
+		return nil, false
+	}
+	var off int64
+	if s, ok := r.(io.Seeker); ok {
+		var err error
+		if off, err = s.Seek(0, io.SeekCurrent); err != nil || off > size {
+			return nil, false
+		}
+	}
+	return io.NewSectionReader(ra, off, size-off), true
+}
+
+// Stream applies the patchSize bytes long patch with oldf to create newf.
+// The old file and the patch are read as needed, so memory use is bounded by
+// the buffer and read ahead sizes whatever the size of the files. newf may
+// have received part of the new file when Stream fails.
+func (p *Patcher) Stream(ctx context.Context, oldf io.ReaderAt, newf io.Writer, patch io.ReaderAt, patchSize int64) error {
+	newfw := bufio.NewWriterSize(newf, p.c.writeBufferSize)
+	if err := patchStream(oldSectionReader(oldf), newfw, patch, patchSize, p.c, p.reporter(ctx)); err != nil {
+		return err
+	}
+	if err := newfw.Flush(); err != nil {
+		return &IOError{"write newfile", err}
+	}
+	return nil
+}
+
+// StreamSeeker is like Stream for a patch that can only be read in order. It
+// seeks between the blocks of the patch as they are decompressed.
+func (p *Patcher) StreamSeeker(ctx context.Context, oldf io.ReaderAt, newf io.Writer, patch io.ReadSeeker) error {
+	patchSize, err := patch.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &IOError{"seek patch", err}
+	}
+	return p.Stream(ctx, oldf, newf, &readSeekerAt{rs: patch}, patchSize)
+}
+
+// WriterAt applies the patchSize bytes long patch with oldf to newf on
+// several goroutines, see WithParallel. The pieces of the new file are written
+// in no particular order; newf is not truncated.
+func (p *Patcher) WriterAt(ctx context.Context, oldf io.ReaderAt, newf io.WriterAt, patch io.ReaderAt, patchSize int64) error {
+	return patchAt(oldf, newf, patch, patchSize, p.c, p.reporter(ctx))
+}
+
+// File applies a patch (using oldfile and patchfile) to create the newfile.
+// The files are read as needed; on Linux the old file and the patch are
+// memory mapped and must not be changed until File returns. The newfile is
+// removed when patching fails.
+func (p *Patcher) File(ctx context.Context, oldfile, newfile, patchfile string) error {
+	oldm, err := util.OpenMapped(oldfile)
+	if err != nil {
+		return &IOError{fmt.Sprintf("could not open oldfile '%s'", oldfile), err}
+	}
+	defer oldm.Close()
+
+	patchm, err := util.OpenMapped(patchfile)
+	if err != nil {
+		return &IOError{fmt.Sprintf("could not open patchfile '%s'", patchfile), err}
+	}
+	defer patchm.Close()
+	oldf, patchf := bytes.NewReader(oldm.Bytes()), bytes.NewReader(patchm.Bytes())
+
+	// truncating a mapped input would crash the program
+	if util.SameFile(newfile, oldfile) || util.SameFile(newfile, patchfile) {
+		return &IOError{fmt.Sprintf("could not create newfile '%s'", newfile), errors.New("newfile is one of the input files")}
+	}
+	newf, err := os.Create(newfile)
+	if err != nil {
+		return &IOError{fmt.Sprintf("could not open or create newfile '%s'", newfile), err}
+	}
+
+	if p.c.parallel {
+		err = p.WriterAt(ctx, oldf, newf, patchf, patchf.Size())
+	} else {
+		err = p.Stream(ctx, oldf, newf, patchf, patchf.Size())
+	}
+	if err != nil {
+		newf.Close()
+		os.Remove(newfile)
+		return fmt.Errorf("bspatch: %w", err)
+	}
+	if err = newf.Close(); err != nil {
+		return fmt.Errorf("bspatch: %w", &IOError{"close newfile", err})
+	}
+	return nil
+}
+
+// reporter returns the progress reporter of a single call
+func (p *Patcher) reporter(ctx context.Context) *progress.Reporter {
+	return progress.NewReporter(ctx, p.c.progress)
+}
+
+// oldSectionReader returns a reader of all of oldf, which also reads it at
+// offsets
+func oldSectionReader(oldf io.ReaderAt) *io.SectionReader {
+	size := sizeOf(oldf)
+	if size < 0 {
+		size = math.MaxInt64
+	}
+	return io.NewSectionReader(oldf, 0, size)
+}
+
+// readSeekerAt reads an io.ReadSeeker at offsets. The block readers take
+// turns, so the reads are serialized.
+type readSeekerAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (r *readSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package bspatch
+
+import (
+	"io"
+	"sync"
+)
+
+// ringBuffer reads a decompressing reader ahead on a goroutine of its own
+// into a buffer of fixed size, so that decompressing the blocks of a patch
+// overlaps with applying it
+type ringBuffer struct {
+	mu sync.Mutex
+	// cond is signalled when data or space becomes available
+	cond *sync.Cond
+	buf  []byte
+	// start and n are the offset and the length of the buffered data
+	start, n int
+	// err is the error that ended the source, or io.ErrClosedPipe after
+	// Close, returned after the data
+	err    error
+	closed bool
+	done   chan struct{}
+}
+
+func newRingBuffer(src io.Reader, size int) *ringBuffer {
+	b := &ringBuffer{
+		buf:  make([]byte, size),
+		done: make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	go b.fill(src)
+	return b
+}
+
+// fill reads src into the free space of the buffer until src fails or the
+// buffer is closed
+func (b *ringBuffer) fill(src io.Reader) {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		for b.n == len(b.buf) && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		// the free space starts after the data and may wrap around
+		var free []byte
+		if end := b.start + b.n; end < len(b.buf) {
+			free = b.buf[end:]
+		} else {
+			free = b.buf[end-len(b.buf) : b.start]
+		}
+		b.mu.Unlock()
+
+		// only this goroutine writes to the free space, so the lock is not
+		// held while decompressing
+		m, err := src.Read(free)
+
+		b.mu.Lock()
+		b.n += m
+		if err != nil && b.err == nil {
+			b.err = err
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *ringBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.n == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.n == 0 {
+		return 0, b.err
+	}
+	m := 0
+	for m < len(p) && b.n > 0 {
+		end := b.start + b.n
+		if end > len(b.buf) {
+			end = len(b.buf)
+		}
+		k := copy(p[m:], b.buf[b.start:end])
+		m += k
+		b.n -= k
+		b.start = (b.start + k) % len(b.buf)
+	}
+	b.cond.Broadcast()
+	return m, nil
+}
+
+// Close stops reading ahead and waits for the goroutine to return. Reads
+// return the data left and then io.ErrClosedPipe, unless the source had ended.
+func (b *ringBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	if b.err == nil {
+		b.err = io.ErrClosedPipe
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	<-b.done
+	return nil
+}
@@ -1,19 +1,28 @@
 package bspatch
 
-import "io"
+import (
+	"io"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
 
 type writeCounter struct {
 	w io.Writer
 	n int64
+	// progress, if set, is updated with the count after every write
+	progress *progress.Reporter
 }
 
 func newWriteCounter(w io.Writer) *writeCounter {
-	return &writeCounter{w, 0}
+	return &writeCounter{w: w}
 }
 
 func (wc *writeCounter) Write(p []byte) (int, error) {
 	n, err := wc.w.Write(p)
 	wc.n += int64(n)
+	if err == nil {
+		err = wc.progress.Update(wc.n)
+	}
 	return n, err
 }
 
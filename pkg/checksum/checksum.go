@@ -0,0 +1,81 @@
+// Package checksum defines the hash algorithms a patch can use to verify the
+// old and new files. Their ids are recorded in the patch.
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc64"
+)
+
+// Algorithm identifies a hash algorithm inside a patch
+type Algorithm uint8
+
+// Supported algorithms
+const (
+	// None disables the check
+	None Algorithm = 0
+	// SHA256 is the default and the only algorithm of the BSDIFF40 layout
+	SHA256 Algorithm = 1
+	// SHA512_256 is SHA-512/256, faster than SHA-256 on 64 bit CPUs without
+	// SHA extensions
+	SHA512_256 Algorithm = 2
+	// CRC64 is CRC-64/ECMA; it detects accidental damage only
+	CRC64 Algorithm = 3
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// New returns a new hash.Hash computing the algorithm. It returns nil for None.
+func (a Algorithm) New() (hash.Hash, error) {
+	switch a {
+	case None:
+		return nil, nil
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512_256:
+		return sha512.New512_256(), nil
+	case CRC64:
+		return crc64.New(crc64Table), nil
+	}
+	return nil, fmt.Errorf("checksum: unknown algorithm %d", uint8(a))
+}
+
+// Size is the digest length in bytes, or -1 for unknown algorithms
+func (a Algorithm) Size() int {
+	switch a {
+	case None:
+		return 0
+	case SHA256, SHA512_256:
+		return 32
+	case CRC64:
+		return 8
+	}
+	return -1
+}
+
+// Sum returns the digest of b
+func (a Algorithm) Sum(b []byte) ([]byte, error) {
+	h, err := a.New()
+	if err != nil || h == nil {
+		return nil, err
+	}
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case None:
+		return "none"
+	case SHA256:
+		return "sha256"
+	case SHA512_256:
+		return "sha512/256"
+	case CRC64:
+		return "crc64"
+	}
+	return fmt.Sprintf("Algorithm(%d)", uint8(a))
+}
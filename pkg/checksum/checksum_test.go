@@ -0,0 +1,21 @@
+package checksum
+
+import "testing"
+
+func TestAlgorithms(t *testing.T) {
+	for _, a := range []Algorithm{SHA256, SHA512_256, CRC64} {
+		sum, err := a.Sum([]byte("bsdiff"))
+		if err != nil {
+			t.Fatal(a, err)
+		}
+		if len(sum) != a.Size() {
+			t.Fatal(a, len(sum), "!=", a.Size())
+		}
+	}
+	if sum, err := None.Sum([]byte("bsdiff")); sum != nil || err != nil {
+		t.Fatal(sum, err)
+	}
+	if _, err := Algorithm(42).New(); err == nil || Algorithm(42).Size() != -1 {
+		t.Fatal("unknown algorithm should fail")
+	}
+}
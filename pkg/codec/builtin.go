@@ -0,0 +1,262 @@
+package codec
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// None stores blocks uncompressed
+type None struct{}
+
+// ID implements Codec
+func (None) ID() ID { return IDNone }
+
+// Name implements Codec
+func (None) Name() string { return "none" }
+
+// NewWriter implements Codec
+func (None) NewWriter(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+
+// NewReader implements Codec
+func (None) NewReader(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil }
+
+// Multistream implements Multistreamer
+func (None) Multistream() bool { return true }
+
+// WriterMemory implements MemoryEstimator
+func (None) WriterMemory() int64 { return 0 }
+
+// ReaderMemory implements MemoryEstimator
+func (None) ReaderMemory() int64 { return 0 }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// LevelAuto makes Bzip2 pick its level from the size of the data, see ForSize
+const LevelAuto = -1
+
+// NoCompression makes Flate, Zlib and Gzip store their data uncompressed.
+// Their zero Level is the default level, so flate.NoCompression (0) would
+// never be picked.
+const NoCompression = -3
+
+// bzip2BlockSize is the block size of bzip2 level 1
+const bzip2BlockSize = 100000
+
+// Bzip2 compresses blocks with bzip2, the codec of the BSDIFF40 format.
+//
+// In bzip2 the level selects the block size: level n sorts blocks of n*100 kB.
+// Level takes precedence over BlockSize, which is rounded up to the next level.
+// When both are zero bzip2.BestCompression is used. The level is not needed to
+// decompress, so it does not change the patch format.
+type Bzip2 struct {
+	// Level is 1 - 9, or LevelAuto
+	Level int
+	// BlockSize is in bytes, at most 900 kB. With LevelAuto it caps the
+	// block size that is picked.
+	BlockSize int
+}
+
+// ID implements Codec
+func (Bzip2) ID() ID { return IDBzip2 }
+
+// Name implements Codec
+func (Bzip2) Name() string { return "bzip2" }
+
+// NewWriter implements Codec
+func (c Bzip2) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level, err := c.level()
+	if err != nil {
+		return nil, err
+	}
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+}
+
+// Multistream implements Multistreamer
+func (Bzip2) Multistream() bool { return true }
+
+// WriterMemory implements MemoryEstimator: about 8 bytes per byte of the
+// block size, for LevelAuto that of level 9
+func (c Bzip2) WriterMemory() int64 {
+	level, err := c.level()
+	if err != nil {
+		level = bzip2.BestCompression
+	}
+	return 8 * int64(level) * bzip2BlockSize
+}
+
+// ReaderMemory implements MemoryEstimator. The block size is only known
+// once reading, so it is that of level 9.
+func (Bzip2) ReaderMemory() int64 { return 5 * bzip2.BestCompression * bzip2BlockSize }
+
+// ForSize resolves LevelAuto for n bytes of data: the smallest block size that
+// holds all of it, since larger blocks only cost time and memory.
+// Other levels are returned unchanged.
+func (c Bzip2) ForSize(n int64) Codec {
+	if c.Level != LevelAuto {
+		return c
+	}
+	maxLevel := bzip2.BestCompression
+	if c.BlockSize > 0 {
+		maxLevel = blockSizeLevel(int64(c.BlockSize))
+	}
+	level := blockSizeLevel(n)
+	if level > maxLevel {
+		level = maxLevel
+	}
+	return Bzip2{Level: level}
+}
+
+func (c Bzip2) level() (int, error) {
+	if c.BlockSize < 0 || c.BlockSize > bzip2.BestCompression*bzip2BlockSize {
+		return 0, fmt.Errorf("codec: invalid bzip2 block size %d", c.BlockSize)
+	}
+	switch {
+	case c.Level == LevelAuto:
+		// no size known, ForSize was not called
+		if c.BlockSize > 0 {
+			return blockSizeLevel(int64(c.BlockSize)), nil
+		}
+		return bzip2.BestCompression, nil
+	case c.Level != 0:
+		if c.Level < bzip2.BestSpeed || c.Level > bzip2.BestCompression {
+			return 0, fmt.Errorf("codec: invalid bzip2 level %d", c.Level)
+		}
+		return c.Level, nil
+	case c.BlockSize > 0:
+		return blockSizeLevel(int64(c.BlockSize)), nil
+	}
+	return bzip2.BestCompression, nil
+}
+
+// blockSizeLevel returns the smallest bzip2 level whose blocks hold n bytes
+func blockSizeLevel(n int64) int {
+	level := int((n + bzip2BlockSize - 1) / bzip2BlockSize)
+	if level < bzip2.BestSpeed {
+		return bzip2.BestSpeed
+	}
+	if level > bzip2.BestCompression {
+		return bzip2.BestCompression
+	}
+	return level
+}
+
+// NewReader implements Codec
+func (Bzip2) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return bzip2.NewReader(r, nil)
+}
+
+// Memory of the DEFLATE based codecs
+const (
+	flateWriterMemory = 1 << 20
+	flateReaderMemory = 128 << 10
+)
+
+// Flate compresses blocks with raw DEFLATE (RFC 1951).
+// A zero Level means flate.DefaultCompression, NoCompression means
+// flate.NoCompression.
+type Flate struct {
+	Level int
+}
+
+// ID implements Codec
+func (Flate) ID() ID { return IDFlate }
+
+// Name implements Codec
+func (Flate) Name() string { return "flate" }
+
+// WriterMemory implements MemoryEstimator
+func (Flate) WriterMemory() int64 { return flateWriterMemory }
+
+// ReaderMemory implements MemoryEstimator
+func (Flate) ReaderMemory() int64 { return flateReaderMemory }
+
+// NewWriter implements Codec
+func (c Flate) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flateLevel(c.Level))
+}
+
+// NewReader implements Codec
+func (Flate) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// Zlib compresses blocks with zlib (RFC 1950).
+// A zero Level means zlib.DefaultCompression, NoCompression means
+// zlib.NoCompression.
+type Zlib struct {
+	Level int
+}
+
+// ID implements Codec
+func (Zlib) ID() ID { return IDZlib }
+
+// Name implements Codec
+func (Zlib) Name() string { return "zlib" }
+
+// WriterMemory implements MemoryEstimator
+func (Zlib) WriterMemory() int64 { return flateWriterMemory }
+
+// ReaderMemory implements MemoryEstimator
+func (Zlib) ReaderMemory() int64 { return flateReaderMemory }
+
+// NewWriter implements Codec
+func (c Zlib) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, flateLevel(c.Level))
+}
+
+// NewReader implements Codec
+func (Zlib) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// Gzip compresses blocks with gzip (RFC 1952).
+// A zero Level means gzip.DefaultCompression, NoCompression means
+// gzip.NoCompression.
+type Gzip struct {
+	Level int
+}
+
+// ID implements Codec
+func (Gzip) ID() ID { return IDGzip }
+
+// Name implements Codec
+func (Gzip) Name() string { return "gzip" }
+
+// WriterMemory implements MemoryEstimator
+func (Gzip) WriterMemory() int64 { return flateWriterMemory }
+
+// ReaderMemory implements MemoryEstimator
+func (Gzip) ReaderMemory() int64 { return flateReaderMemory }
+
+// NewWriter implements Codec
+func (c Gzip) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, flateLevel(c.Level))
+}
+
+// NewReader implements Codec
+func (Gzip) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Multistream implements Multistreamer
+func (Gzip) Multistream() bool { return true }
+
+func flateLevel(level int) int {
+	switch level {
+	case 0:
+		return flate.DefaultCompression
+	case NoCompression:
+		return flate.NoCompression
+	}
+	return level
+}
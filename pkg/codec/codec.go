@@ -0,0 +1,146 @@
+// Package codec provides the compression codecs used for the blocks of a patch.
+//
+// Every codec has an ID which is recorded in the patch so bspatch can pick the
+// matching decompressor. The built-in codecs are registered on init; custom
+// codecs can be added with Register.
+package codec
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ID identifies a codec inside a patch
+type ID uint8
+
+// IDs of the built-in codecs. ID 2 is left out, it is brotli in Android's
+// BSDF2 format. IDs below 64 are reserved for this package; custom codecs
+// should use 64 - 255.
+const (
+	IDNone  ID = 0
+	IDBzip2 ID = 1
+	IDFlate ID = 3
+	IDZlib  ID = 4
+	IDGzip  ID = 5
+)
+
+// Codec compresses and decompresses a single patch block
+type Codec interface {
+	// ID is the identifier recorded in the patch
+	ID() ID
+	// Name is a human readable name, unique among registered codecs
+	Name() string
+	// NewWriter returns a writer compressing into w. Closing it must flush all
+	// data to w but must not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing from r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Sizer is implemented by codecs that tune their settings to the amount of
+// data they are about to compress. ForSize returns the codec to use for n bytes.
+type Sizer interface {
+	ForSize(n int64) Codec
+}
+
+// Multistreamer is implemented by codecs whose readers decode concatenated
+// streams as a single one, so that a block can be compressed in independent
+// chunks
+type Multistreamer interface {
+	Multistream() bool
+}
+
+// Multistream reports whether c reads concatenated streams as one
+func Multistream(c Codec) bool {
+	m, ok := c.(Multistreamer)
+	return ok && m.Multistream()
+}
+
+// ForSize returns c tuned for n bytes if it implements Sizer, or c itself
+func ForSize(c Codec, n int64) Codec {
+	if s, ok := c.(Sizer); ok {
+		return s.ForSize(n)
+	}
+	return c
+}
+
+// MemoryEstimator is implemented by codecs that know about how much memory
+// their writers and readers use
+type MemoryEstimator interface {
+	WriterMemory() int64
+	ReaderMemory() int64
+}
+
+// DefaultMemory is assumed for the writers and readers of codecs that do not
+// implement MemoryEstimator
+const DefaultMemory = 1 << 20
+
+// WriterMemory returns about how much memory a writer of c uses
+func WriterMemory(c Codec) int64 {
+	if m, ok := c.(MemoryEstimator); ok {
+		return m.WriterMemory()
+	}
+	return DefaultMemory
+}
+
+// ReaderMemory returns about how much memory a reader of c uses
+func ReaderMemory(c Codec) int64 {
+	if m, ok := c.(MemoryEstimator); ok {
+		return m.ReaderMemory()
+	}
+	return DefaultMemory
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[ID]Codec{}
+)
+
+func init() {
+	for _, c := range []Codec{None{}, Bzip2{}, Flate{}, Zlib{}, Gzip{}} {
+		if err := Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register makes c available to Lookup and ByName. It fails if the ID or
+// the name is already taken.
+func Register(c Codec) error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if prev, ok := registry[c.ID()]; ok {
+		return fmt.Errorf("codec: id %d already registered by %s", c.ID(), prev.Name())
+	}
+	for _, prev := range registry {
+		if prev.Name() == c.Name() {
+			return fmt.Errorf("codec: name %s already registered with id %d", c.Name(), prev.ID())
+		}
+	}
+	registry[c.ID()] = c
+	return nil
+}
+
+// Lookup returns the codec registered for id
+func Lookup(id ID) (Codec, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	c, ok := registry[id]
+	if !ok {
+		return nil, fmt.Errorf("codec: unknown codec id %d", id)
+	}
+	return c, nil
+}
+
+// ByName returns the registered codec called name
+func ByName(name string) (Codec, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	for _, c := range registry {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("codec: unknown codec %q", name)
+}
@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("bsdiff codec round trip "), 100)
+	for _, id := range []ID{IDNone, IDBzip2, IDFlate, IDZlib, IDGzip} {
+		c, err := Lookup(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		w, err := c.NewWriter(buf)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		r, err := c.NewReader(buf)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal(c.Name(), "round trip mismatch")
+		}
+	}
+}
+
+func TestMultistream(t *testing.T) {
+	data := bytes.Repeat([]byte("bsdiff codec multistream "), 100)
+	for _, id := range []ID{IDNone, IDBzip2, IDFlate, IDZlib, IDGzip} {
+		c, err := Lookup(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Multistream(c) {
+			continue
+		}
+		// three streams of a third each must read back as one
+		buf := new(bytes.Buffer)
+		for i := 0; i < 3; i++ {
+			w, err := c.NewWriter(buf)
+			if err != nil {
+				t.Fatal(c.Name(), err)
+			}
+			w.Write(data[i*len(data)/3 : (i+1)*len(data)/3])
+			if err := w.Close(); err != nil {
+				t.Fatal(c.Name(), err)
+			}
+		}
+		r, err := c.NewReader(buf)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal(c.Name(), "multistream mismatch")
+		}
+	}
+}
+
+type testCodec struct {
+	None
+	id   ID
+	name string
+}
+
+func (c testCodec) ID() ID       { return c.id }
+func (c testCodec) Name() string { return c.name }
+
+func TestRegister(t *testing.T) {
+	if err := Register(testCodec{id: IDBzip2, name: "test-dup-id"}); err == nil {
+		t.Fatal("duplicate id should fail")
+	}
+	if err := Register(testCodec{id: 200, name: "bzip2"}); err == nil {
+		t.Fatal("duplicate name should fail")
+	}
+	if err := Register(testCodec{id: 200, name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ByName("test")
+	if err != nil || c.ID() != 200 {
+		t.Fatal(c, err)
+	}
+	if _, err := Lookup(201); err == nil {
+		t.Fatal("unknown id should fail")
+	}
+	if _, err := ByName("unknown"); err == nil {
+		t.Fatal("unknown name should fail")
+	}
+}
+
+func TestBzip2Level(t *testing.T) {
+	tests := []struct {
+		c     Codec
+		size  int64
+		level byte
+	}{
+		{Bzip2{}, 0, '9'},
+		{Bzip2{Level: 3}, 0, '3'},
+		{Bzip2{BlockSize: 250000}, 0, '3'},
+		{Bzip2{Level: 2, BlockSize: 900000}, 0, '2'},
+		{Bzip2{Level: LevelAuto}, 10, '1'},
+		{Bzip2{Level: LevelAuto}, 450000, '5'},
+		{Bzip2{Level: LevelAuto}, 1 << 30, '9'},
+		{Bzip2{Level: LevelAuto, BlockSize: 200000}, 1 << 30, '2'},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		w, err := ForSize(test.c, test.size).NewWriter(buf)
+		if err != nil {
+			t.Fatal(test.c, err)
+		}
+		w.Close()
+		if hdr := buf.Bytes()[:4]; hdr[3] != test.level {
+			t.Errorf("%+v for %d bytes: got header %q, want level %c", test.c, test.size, hdr, test.level)
+		}
+	}
+	for _, c := range []Bzip2{{Level: 10}, {Level: -2}, {BlockSize: 900001}} {
+		if _, err := c.NewWriter(ioutil.Discard); err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+}
+
+func TestFlateLevel(t *testing.T) {
+	data := bytes.Repeat([]byte("bsdiff codec flate level "), 100)
+	for _, c := range []Codec{Flate{Level: NoCompression}, Zlib{Level: NoCompression}, Gzip{Level: NoCompression}} {
+		buf := new(bytes.Buffer)
+		w, err := c.NewWriter(buf)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		// stored blocks keep the data verbatim
+		if buf.Len() < len(data) || !bytes.Contains(buf.Bytes(), data[:1000]) {
+			t.Errorf("%s: %d bytes of %d are not stored", c.Name(), buf.Len(), len(data))
+		}
+	}
+	buf := new(bytes.Buffer)
+	w, _ := Flate{}.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	if buf.Len() >= len(data) {
+		t.Errorf("zero level should compress, got %d bytes of %d", buf.Len(), len(data))
+	}
+}
@@ -0,0 +1,233 @@
+// Package container implements the header of the extensible BSDIFFEX patch format.
+//
+// File format (little endian):
+//
+//	--- header ---
+//	 0     -  7       : "BSDIFFEX"
+//	 8     -  9       : version
+//	10     - 11       : flags
+//	12     - 15       : H, length of the header including the extensions
+//	16     - 23       : len(newfile)
+//	24     - 31       : X, length of the compressed control block
+//	32     - 39       : Y, length of the compressed diff block
+//	40     - 47       : Z, length of the compressed extra block
+//	48     - H-1      : extension records
+//	---  data  ---
+//	H      - H+X-1    : control block
+//	H+X    - H+X+Y-1  : diff block
+//	H+X+Y  - H+X+Y+Z-1: extra block
+//
+// Every extension record is a 2 byte type, a 4 byte length L and L bytes of
+// value. Readers skip records they do not know unless the type has the
+// Critical bit set, in which case the patch can not be applied.
+package container
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// Magic starts every BSDIFFEX patch
+	Magic = "BSDIFFEX"
+	// Version is the format version written and understood by this package
+	Version = 1
+	// FixedLen is the length of the header without extensions
+	FixedLen = 48
+
+	recordHeaderLen = 6
+)
+
+// ExtType is the type of an extension record
+type ExtType uint16
+
+// Critical marks extension records a reader must understand
+const Critical ExtType = 0x8000
+
+// Extension types defined by this package. Types below 0x4000 (ignoring the
+// Critical bit) are reserved; applications may use 0x4000 - 0x7fff.
+const (
+	// ExtCodecs holds the codec ids of the control, diff and extra blocks.
+	// Without it all blocks are bzip2.
+	ExtCodecs = Critical | 0x0001
+	// ExtOldHash holds the checksum.Algorithm id followed by the digest of
+	// the old file
+	ExtOldHash ExtType = 0x0002
+	// ExtMetadata holds free form application data
+	ExtMetadata ExtType = 0x0003
+	// ExtNewHash holds the checksum.Algorithm id followed by the digest of
+	// the new file, which readers verify while writing it
+	ExtNewHash ExtType = 0x0004
+)
+
+// IsCritical reports whether readers must understand t
+func (t ExtType) IsCritical() bool {
+	return t&Critical != 0
+}
+
+// known are the critical types this version understands
+var known = map[ExtType]bool{
+	ExtCodecs: true,
+}
+
+// Extension is a typed record of the header
+type Extension struct {
+	Type  ExtType
+	Value []byte
+}
+
+// Header is a parsed BSDIFFEX header
+type Header struct {
+	Version    uint16
+	Flags      uint16
+	NewSize    int64
+	CtrlLen    int64
+	DiffLen    int64
+	ExtraLen   int64
+	Extensions []Extension
+}
+
+var (
+	// ErrShortHeader is returned when fewer bytes than the header length are given
+	ErrShortHeader = errors.New("container: short header")
+	// ErrBadMagic is returned when the data does not start with Magic
+	ErrBadMagic = errors.New("container: incorrect magic number (header " + Magic + ")")
+)
+
+// UnsupportedError is returned for headers this version can not apply: a newer
+// version, unknown flags or unknown critical extensions
+type UnsupportedError struct {
+	What string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "container: unsupported " + e.What
+}
+
+// Len is the encoded length of h
+func (h *Header) Len() int {
+	n := FixedLen
+	for _, e := range h.Extensions {
+		n += recordHeaderLen + len(e.Value)
+	}
+	return n
+}
+
+// Extension returns the value of the first record of type t
+func (h *Header) Extension(t ExtType) ([]byte, bool) {
+	for _, e := range h.Extensions {
+		if e.Type == t {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalBinary encodes h
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if h.NewSize < 0 || h.CtrlLen < 0 || h.DiffLen < 0 || h.ExtraLen < 0 {
+		return nil, fmt.Errorf("container: negative length in header")
+	}
+	n := h.Len()
+	if n > maxHeaderLen {
+		return nil, fmt.Errorf("container: header too large (%v bytes)", n)
+	}
+	version := h.Version
+	if version == 0 {
+		version = Version
+	}
+	b := make([]byte, FixedLen, n)
+	copy(b, Magic)
+	binary.LittleEndian.PutUint16(b[8:], version)
+	binary.LittleEndian.PutUint16(b[10:], h.Flags)
+	binary.LittleEndian.PutUint32(b[12:], uint32(n))
+	binary.LittleEndian.PutUint64(b[16:], uint64(h.NewSize))
+	binary.LittleEndian.PutUint64(b[24:], uint64(h.CtrlLen))
+	binary.LittleEndian.PutUint64(b[32:], uint64(h.DiffLen))
+	binary.LittleEndian.PutUint64(b[40:], uint64(h.ExtraLen))
+	var rec [recordHeaderLen]byte
+	for _, e := range h.Extensions {
+		binary.LittleEndian.PutUint16(rec[0:], uint16(e.Type))
+		binary.LittleEndian.PutUint32(rec[2:], uint32(len(e.Value)))
+		b = append(b, rec[:]...)
+		b = append(b, e.Value...)
+	}
+	return b, nil
+}
+
+// maxHeaderLen bounds the header so a corrupt length can not trigger huge reads
+const maxHeaderLen = 1 << 20
+
+// HeaderLen returns the total header length recorded in the fixed part of a
+// header, so callers know how many bytes to pass to ParseHeader
+func HeaderLen(b []byte) (int, error) {
+	if len(b) < FixedLen {
+		if !bytes.HasPrefix([]byte(Magic), b[:min(len(b), len(Magic))]) {
+			return 0, ErrBadMagic
+		}
+		return 0, ErrShortHeader
+	}
+	if !bytes.Equal(b[:len(Magic)], []byte(Magic)) {
+		return 0, ErrBadMagic
+	}
+	n := binary.LittleEndian.Uint32(b[12:])
+	if n < FixedLen || n > maxHeaderLen {
+		return 0, fmt.Errorf("container: invalid header length %v", n)
+	}
+	return int(n), nil
+}
+
+// ParseHeader decodes the header at the start of b, which must hold at least
+// HeaderLen bytes. Unknown optional extensions are kept but ignored.
+func ParseHeader(b []byte) (*Header, error) {
+	n, err := HeaderLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < n {
+		return nil, ErrShortHeader
+	}
+	h := &Header{
+		Version:  binary.LittleEndian.Uint16(b[8:]),
+		Flags:    binary.LittleEndian.Uint16(b[10:]),
+		NewSize:  int64(binary.LittleEndian.Uint64(b[16:])),
+		CtrlLen:  int64(binary.LittleEndian.Uint64(b[24:])),
+		DiffLen:  int64(binary.LittleEndian.Uint64(b[32:])),
+		ExtraLen: int64(binary.LittleEndian.Uint64(b[40:])),
+	}
+	if h.Version == 0 || h.Version > Version {
+		return nil, &UnsupportedError{fmt.Sprintf("version %v", h.Version)}
+	}
+	if h.Flags != 0 {
+		return nil, &UnsupportedError{fmt.Sprintf("flags %#04x", h.Flags)}
+	}
+	if h.NewSize < 0 || h.CtrlLen < 0 || h.DiffLen < 0 || h.ExtraLen < 0 {
+		return nil, fmt.Errorf("container: negative length in header")
+	}
+	for off := FixedLen; off < n; {
+		if n-off < recordHeaderLen {
+			return nil, fmt.Errorf("container: truncated extension record at %v", off)
+		}
+		t := ExtType(binary.LittleEndian.Uint16(b[off:]))
+		l := int(binary.LittleEndian.Uint32(b[off+2:]))
+		off += recordHeaderLen
+		if l > n-off {
+			return nil, fmt.Errorf("container: extension %#04x exceeds header (%v > %v)", uint16(t), l, n-off)
+		}
+		if t.IsCritical() && !known[t] {
+			return nil, &UnsupportedError{fmt.Sprintf("critical extension %#04x", uint16(t))}
+		}
+		h.Extensions = append(h.Extensions, Extension{Type: t, Value: b[off : off+l]})
+		off += l
+	}
+	return h, nil
+}
+
+func min(a, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	h := &Header{
+		NewSize:  1234,
+		CtrlLen:  10,
+		DiffLen:  20,
+		ExtraLen: 30,
+		Extensions: []Extension{
+			{Type: ExtCodecs, Value: []byte{1, 1, 1}},
+			{Type: ExtMetadata, Value: []byte("release 1.2")},
+			{Type: 0x4001, Value: nil},
+		},
+	}
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != h.Len() {
+		t.Fatal(len(b), "!=", h.Len())
+	}
+	n, err := HeaderLen(b[:FixedLen])
+	if err != nil || n != len(b) {
+		t.Fatal(n, err)
+	}
+	h2, err := ParseHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Version != Version || h2.NewSize != 1234 || h2.CtrlLen != 10 || h2.DiffLen != 20 || h2.ExtraLen != 30 {
+		t.Fatalf("%+v", h2)
+	}
+	if len(h2.Extensions) != 3 {
+		t.Fatal(h2.Extensions)
+	}
+	meta, ok := h2.Extension(ExtMetadata)
+	if !ok || !bytes.Equal(meta, []byte("release 1.2")) {
+		t.Fatal(meta, ok)
+	}
+	if _, ok := h2.Extension(ExtOldHash); ok {
+		t.Fatal("unexpected old hash extension")
+	}
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+	h := &Header{Extensions: []Extension{{Type: Critical | 0x4001, Value: []byte{1}}}}
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseHeader(b); err == nil {
+		t.Fatal("unknown critical extension should fail")
+	} else if _, ok := err.(*UnsupportedError); !ok {
+		t.Fatal(err)
+	}
+	if _, err := ParseHeader(b[:len(b)-1]); err != ErrShortHeader {
+		t.Fatal(err)
+	}
+	if _, err := ParseHeader([]byte("BSDIFF40")); err != ErrBadMagic {
+		t.Fatal(err)
+	}
+
+	v2 := append([]byte{}, b...)
+	v2[8] = 2
+	if _, err := ParseHeader(v2); err == nil {
+		t.Fatal("newer version should fail")
+	}
+
+	// a record claiming more bytes than the header holds
+	h = &Header{Extensions: []Extension{{Type: ExtMetadata, Value: []byte{1, 2}}}}
+	b, _ = h.MarshalBinary()
+	b[FixedLen+2] = 3
+	if _, err := ParseHeader(b); err == nil {
+		t.Fatal("overlong record should fail")
+	}
+}
@@ -0,0 +1,141 @@
+// Package progress reports the progress of bsdiff and bspatch and stops them
+// when their context is cancelled.
+package progress
+
+import (
+	"context"
+	"fmt"
+)
+
+// Phase is a step of generating or applying a patch
+type Phase int
+
+const (
+	// Hashing computes or verifies file checksums
+	Hashing Phase = iota
+	// Sorting builds the suffix array, or hash table, of the old file
+	Sorting
+	// Scanning searches the new file for matches in the old file
+	Scanning
+	// Compressing writes the compressed blocks of the patch
+	Compressing
+	// Applying writes the new file
+	Applying
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Hashing:
+		return "hashing"
+	case Sorting:
+		return "sorting"
+	case Scanning:
+		return "scanning"
+	case Compressing:
+		return "compressing"
+	case Applying:
+		return "applying"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// Func receives the number of bytes done out of total in the current phase.
+// It is called from the goroutine doing the work and should return quickly.
+type Func func(phase Phase, done, total int64)
+
+// steps is roughly how many times a phase is reported
+const steps = 256
+
+// checkEvery is how many bytes of work may pass between two context checks
+const checkEvery = 1 << 16
+
+// Reporter calls a Func at most about steps times per phase and checks the
+// context along the way. A nil *Reporter never reports and is never cancelled.
+type Reporter struct {
+	ctx   context.Context
+	fn    Func
+	phase Phase
+	total int64
+	// step is the distance between two reports, next the done value of the
+	// next report
+	step int64
+	next int64
+	// check is the done value of the next context check
+	check int64
+	// last is the done value of the last report
+	last int64
+}
+
+// NewReporter returns a Reporter for ctx and fn; fn may be nil
+func NewReporter(ctx context.Context, fn Func) *Reporter {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Reporter{ctx: ctx, fn: fn}
+}
+
+// Quiet returns a Reporter that checks the same context but reports nothing,
+// for work split across goroutines; a Reporter is not safe for concurrent use
+func (r *Reporter) Quiet() *Reporter {
+	if r == nil {
+		return nil
+	}
+	return &Reporter{ctx: r.ctx}
+}
+
+// Context returns the context checked by r
+func (r *Reporter) Context() context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Start begins a phase of total bytes and reports 0 of total
+func (r *Reporter) Start(phase Phase, total int64) error {
+	if r == nil {
+		return nil
+	}
+	r.phase, r.total = phase, total
+	r.step = total / steps
+	if r.step < 1 {
+		r.step = 1
+	}
+	r.next, r.check, r.last = 0, 0, -1
+	return r.Update(0)
+}
+
+// Update reports done bytes of the current phase when enough progress was
+// made since the last report, and returns the context error if any
+func (r *Reporter) Update(done int64) error {
+	if r == nil {
+		return nil
+	}
+	if done >= r.next || (done >= r.total && r.last != done) {
+		if r.fn != nil {
+			r.fn(r.phase, done, r.total)
+		}
+		r.next, r.last = done+r.step, done
+	}
+	if done >= r.check || done >= r.total {
+		r.check = done + checkEvery
+		return r.ctx.Err()
+	}
+	return nil
+}
+
+// Finish reports the current phase as done
+func (r *Reporter) Finish() error {
+	if r == nil {
+		return nil
+	}
+	return r.Update(r.total)
+}
+
+// Err returns the context error
+func (r *Reporter) Err() error {
+	if r == nil {
+		return nil
+	}
+	return r.ctx.Err()
+}
@@ -0,0 +1,49 @@
+package progress
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReporter(t *testing.T) {
+	var calls int
+	var last int64
+	r := NewReporter(context.Background(), func(phase Phase, done, total int64) {
+		if phase != Scanning || total != 1000000 || done < last {
+			t.Fatal(phase, done, total, last)
+		}
+		calls++
+		last = done
+	})
+	if err := r.Start(Scanning, 1000000); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i <= 1000000; i++ {
+		if err := r.Update(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if calls < steps || calls > steps+2 || last != 1000000 {
+		t.Fatal("unexpected number of reports", calls, last)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r = NewReporter(ctx, nil)
+	r.Start(Applying, 1<<30)
+	cancel()
+	var err error
+	for i := int64(0); err == nil && i < 2*checkEvery; i++ {
+		err = r.Update(i)
+	}
+	if err != context.Canceled {
+		t.Fatal("expected the reporter to be cancelled, got", err)
+	}
+
+	var nilReporter *Reporter
+	if nilReporter.Start(Hashing, 1) != nil || nilReporter.Update(1) != nil || nilReporter.Finish() != nil {
+		t.Fatal("nil reporter should do nothing")
+	}
+}
@@ -0,0 +1,591 @@
+package sufsort
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+	"github.com/kiteco/go-bsdiff/pkg/util"
+)
+
+// DefaultMemoryLimit is the memory limit of an External sorter without one
+const DefaultMemoryLimit = 256 << 20
+
+// External builds suffix arrays larger than memory in files in Dir, or
+// os.TempDir() if Dir is empty, using about MemoryLimit bytes of memory.
+// Inputs small enough to be sorted in MemoryLimit are sorted with SAIS.
+//
+// It sorts by prefix doubling: the suffixes are sorted by their first 14
+// bytes, then by twice as many in every round using the order of the last,
+// until all of them differ. Every round sorts 24 bytes per input byte on disk
+// in runs that are merged, so it needs about 50 bytes of disk space per input
+// byte and is many times slower than SAIS.
+//
+// The returned Array is a memory mapped file in Dir (on Linux; elsewhere it
+// is read into memory). It implements io.Closer, which removes the file.
+type External struct {
+	Dir         string
+	MemoryLimit int64
+}
+
+// Name returns "external"
+func (External) Name() string { return "external" }
+
+// Memory implements MemoryEstimator. The mapped suffix array is not counted.
+func (e External) Memory(n int64) int64 {
+	if e.inMemory(n) {
+		return SAIS{}.Memory(n)
+	}
+	return e.memoryLimit()
+}
+
+func (e External) memoryLimit() int64 {
+	if e.MemoryLimit <= 0 {
+		return DefaultMemoryLimit
+	}
+	return e.MemoryLimit
+}
+
+// inMemory reports whether n bytes are sorted with SAIS
+func (e External) inMemory(n int64) bool {
+	return n < math.MaxInt32 && SAIS{}.Memory(n) <= e.memoryLimit()
+}
+
+// Sort returns the suffix array of buf
+func (e External) Sort(buf []byte, r *progress.Reporter) (Array, error) {
+	if e.inMemory(int64(len(buf))) {
+		return SAIS{}.Sort(buf, r)
+	}
+
+	dir, err := ioutil.TempDir(e.Dir, "sufsort-")
+	if err != nil {
+		return nil, err
+	}
+	sa, err := externalSort(buf, dir, e.memoryLimit(), r)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return sa, nil
+}
+
+// record is a tuple sorted on disk: two sort keys and a suffix offset, or a
+// suffix offset and its rank
+type record [3]uint64
+
+const recordSize = 24
+
+func (x record) less(y record) bool {
+	if x[0] != y[0] {
+		return x[0] < y[0]
+	}
+	if x[1] != y[1] {
+		return x[1] < y[1]
+	}
+	return x[2] < y[2]
+}
+
+// key7 packs the 7 bytes of buf at i into 63 bits, each byte plus one in 9
+// bits. Bytes past the end of buf are 0, which sorts them before any byte.
+func key7(buf []byte, i int) uint64 {
+	var k uint64
+	for j := i; j < i+7; j++ {
+		k <<= 9
+		if j < len(buf) {
+			k |= uint64(buf[j]) + 1
+		}
+	}
+	return k
+}
+
+func externalSort(buf []byte, dir string, mem int64, r *progress.Reporter) (Array, error) {
+	n := len(buf)
+	s := newExtSorter(dir, mem, r)
+	if err := r.Start(progress.Sorting, int64(n)+1); err != nil {
+		return nil, err
+	}
+
+	// The first round sorts by the first 14 bytes, every next round by twice
+	// as many: the rank of a suffix for h bytes followed by the rank of the
+	// suffix h bytes later
+	runs := s.newRuns()
+	for i := 0; i < n; i++ {
+		if err := runs.add(record{key7(buf, i), key7(buf, i+7), uint64(i)}); err != nil {
+			runs.remove()
+			return nil, err
+		}
+	}
+	sorted, err := runs.finish()
+	if err != nil {
+		return nil, err
+	}
+	for h := 14; ; h *= 2 {
+		groups, err := s.rank(sorted, n)
+		if err != nil {
+			os.Remove(sorted)
+			return nil, err
+		}
+		// the empty suffix is a group of its own
+		if err := r.Update(int64(groups) + 1); err != nil {
+			os.Remove(sorted)
+			return nil, err
+		}
+		if groups == n {
+			// all suffixes differ in their first h bytes
+			sa, err := s.writeArray(sorted, n)
+			os.Remove(sorted)
+			os.Remove(s.rankFile())
+			return sa, err
+		}
+		os.Remove(sorted)
+		if sorted, err = s.pairs(n, h); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// extSorter sorts records in files of dir using at most about mem bytes
+type extSorter struct {
+	dir     string
+	mem     int64
+	bufSize int
+	fanout  int
+	files   int
+	r       *progress.Reporter
+	ticks   int
+}
+
+func newExtSorter(dir string, mem int64, r *progress.Reporter) *extSorter {
+	bufSize := 64 << 10
+	if mem < 4<<20 {
+		bufSize = 4 << 10
+	}
+	fanout := int(mem / 2 / int64(bufSize))
+	if fanout < 2 {
+		fanout = 2
+	}
+	return &extSorter{dir: dir, mem: mem, bufSize: bufSize, fanout: fanout, r: r}
+}
+
+// tick checks for cancellation every so many records
+func (s *extSorter) tick() error {
+	s.ticks++
+	if s.ticks&(1<<16-1) == 0 {
+		return s.r.Err()
+	}
+	return nil
+}
+
+// name returns the name of a new file in the scratch directory
+func (s *extSorter) name() string {
+	s.files++
+	return filepath.Join(s.dir, fmt.Sprintf("run-%d", s.files))
+}
+
+func (s *extSorter) rankFile() string {
+	return filepath.Join(s.dir, "ranks")
+}
+
+// rank assigns every suffix of the sorted records the rank of its group, one
+// plus the position of the first record of the group, and writes the ranks in
+// suffix order to the rank file. It returns the number of groups.
+func (s *extSorter) rank(sorted string, n int) (int, error) {
+	in, err := s.open(sorted)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	runs := s.newRuns()
+	var prev record
+	var rank uint64
+	groups := 0
+	for pos := 0; pos < n; pos++ {
+		x, err := in.read()
+		if err != nil {
+			runs.remove()
+			return 0, err
+		}
+		if pos == 0 || x[0] != prev[0] || x[1] != prev[1] {
+			rank = uint64(pos) + 1
+			groups++
+		}
+		prev = x
+		if err := runs.add(record{x[2], rank, 0}); err != nil {
+			runs.remove()
+			return 0, err
+		}
+	}
+	if groups == n {
+		// the order is final, the ranks are not needed anymore
+		runs.remove()
+		return groups, nil
+	}
+	bySuffix, err := runs.finish()
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(bySuffix)
+
+	ranked, err := s.open(bySuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer ranked.Close()
+	f, err := os.Create(s.rankFile())
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriterSize(f, s.bufSize)
+	var b [8]byte
+	for i := 0; i < n; i++ {
+		x, err := ranked.read()
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		binary.LittleEndian.PutUint64(b[:], x[1])
+		w.Write(b[:])
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return groups, f.Close()
+}
+
+// pairs sorts the suffixes by their rank followed by the rank of the suffix
+// h bytes later, which is 0 past the end
+func (s *extSorter) pairs(n, h int) (string, error) {
+	f, err := os.Open(s.rankFile())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	ra := bufio.NewReaderSize(io.NewSectionReader(f, 0, int64(n)*8), s.bufSize)
+	rb := bufio.NewReaderSize(io.NewSectionReader(f, int64(h)*8, math.MaxInt64), s.bufSize)
+	var a, b [8]byte
+	runs := s.newRuns()
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(ra, a[:]); err != nil {
+			runs.remove()
+			return "", err
+		}
+		var next uint64
+		if i+h < n {
+			if _, err := io.ReadFull(rb, b[:]); err != nil {
+				runs.remove()
+				return "", err
+			}
+			next = binary.LittleEndian.Uint64(b[:])
+		}
+		if err := runs.add(record{binary.LittleEndian.Uint64(a[:]), next, uint64(i)}); err != nil {
+			runs.remove()
+			return "", err
+		}
+	}
+	return runs.finish()
+}
+
+// writeArray writes the suffix array of the sorted records and maps it
+func (s *extSorter) writeArray(sorted string, n int) (Array, error) {
+	in, err := s.open(sorted)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	width := 4
+	if int64(n) >= math.MaxUint32 {
+		width = 8
+	}
+	name := filepath.Join(s.dir, "sa")
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriterSize(f, s.bufSize)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(n))
+	w.Write(b[:width])
+	for i := 0; i < n; i++ {
+		x, err := in.read()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(b[:], x[2])
+		w.Write(b[:width])
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	m, err := util.OpenMapped(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileArray{m: m, data: m.Bytes(), width: width, dir: s.dir}, nil
+}
+
+// fileArray is a suffix array in a memory mapped file
+type fileArray struct {
+	m     *util.MappedFile
+	data  []byte
+	width int
+	dir   string
+}
+
+// Len returns the number of entries
+func (a *fileArray) Len() int { return len(a.data) / a.width }
+
+// At returns the offset of the i-th smallest suffix
+func (a *fileArray) At(i int) int {
+	if a.width == 4 {
+		return int(binary.LittleEndian.Uint32(a.data[4*i:]))
+	}
+	return int(binary.LittleEndian.Uint64(a.data[8*i:]))
+}
+
+// Close unmaps the file and removes it
+func (a *fileArray) Close() error {
+	a.data = nil
+	err := a.m.Close()
+	if rerr := os.RemoveAll(a.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// runs collects records into sorted run files
+type runs struct {
+	s    *extSorter
+	buf  []record
+	runs []string
+}
+
+func (s *extSorter) newRuns() *runs {
+	n := s.mem / 2 / recordSize
+	if n < 1024 {
+		n = 1024
+	}
+	return &runs{s: s, buf: make([]record, 0, n)}
+}
+
+func (rs *runs) add(x record) error {
+	rs.buf = append(rs.buf, x)
+	if len(rs.buf) == cap(rs.buf) {
+		if err := rs.spill(); err != nil {
+			return err
+		}
+	}
+	return rs.s.tick()
+}
+
+// spill sorts the buffered records into a run file
+func (rs *runs) spill() error {
+	sort.Slice(rs.buf, func(i, j int) bool { return rs.buf[i].less(rs.buf[j]) })
+	name := rs.s.name()
+	rs.runs = append(rs.runs, name)
+	w, err := rs.s.create(name)
+	if err != nil {
+		return err
+	}
+	for _, x := range rs.buf {
+		w.write(x)
+	}
+	rs.buf = rs.buf[:0]
+	return w.Close()
+}
+
+// finish returns a file of all records in order
+func (rs *runs) finish() (string, error) {
+	if len(rs.buf) > 0 || len(rs.runs) == 0 {
+		if err := rs.spill(); err != nil {
+			rs.remove()
+			return "", err
+		}
+	}
+	rs.buf = nil
+	for len(rs.runs) > 1 {
+		var merged []string
+		for i := 0; i < len(rs.runs); i += rs.s.fanout {
+			end := i + rs.s.fanout
+			if end > len(rs.runs) {
+				end = len(rs.runs)
+			}
+			name, err := rs.s.merge(rs.runs[i:end])
+			if err != nil {
+				rs.runs = append(merged, rs.runs[i:]...)
+				rs.remove()
+				return "", err
+			}
+			merged = append(merged, name)
+		}
+		rs.runs = merged
+	}
+	return rs.runs[0], nil
+}
+
+// remove removes the run files
+func (rs *runs) remove() {
+	for _, name := range rs.runs {
+		os.Remove(name)
+	}
+	rs.runs = nil
+}
+
+// merge merges the run files into a new one and removes them
+func (s *extSorter) merge(names []string) (string, error) {
+	h := &runHeap{}
+	defer func() {
+		for _, in := range h.readers {
+			in.Close()
+		}
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}()
+	for _, name := range names {
+		in, err := s.open(name)
+		if err != nil {
+			return "", err
+		}
+		h.readers = append(h.readers, in)
+		x, err := in.read()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		h.heads = append(h.heads, runHead{x, in})
+	}
+	heap.Init(h)
+
+	name := s.name()
+	w, err := s.create(name)
+	if err != nil {
+		return "", err
+	}
+	for h.Len() > 0 {
+		head := &h.heads[0]
+		w.write(head.x)
+		x, err := head.in.read()
+		switch {
+		case err == io.EOF:
+			heap.Pop(h)
+		case err != nil:
+			w.Close()
+			os.Remove(name)
+			return "", err
+		default:
+			head.x = x
+			heap.Fix(h, 0)
+		}
+		if err := s.tick(); err != nil {
+			w.Close()
+			os.Remove(name)
+			return "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+type runHead struct {
+	x  record
+	in *recordReader
+}
+
+// runHeap orders the runs of a merge by their next record
+type runHeap struct {
+	heads   []runHead
+	readers []*recordReader
+}
+
+func (h *runHeap) Len() int           { return len(h.heads) }
+func (h *runHeap) Less(i, j int) bool { return h.heads[i].x.less(h.heads[j].x) }
+func (h *runHeap) Swap(i, j int)      { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *runHeap) Push(x interface{}) { h.heads = append(h.heads, x.(runHead)) }
+func (h *runHeap) Pop() interface{} {
+	x := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return x
+}
+
+// recordWriter writes records to a file
+type recordWriter struct {
+	f *os.File
+	w *bufio.Writer
+	b [recordSize]byte
+}
+
+func (s *extSorter) create(name string) (*recordWriter, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &recordWriter{f: f, w: bufio.NewWriterSize(f, s.bufSize)}, nil
+}
+
+func (w *recordWriter) write(x record) {
+	binary.LittleEndian.PutUint64(w.b[0:], x[0])
+	binary.LittleEndian.PutUint64(w.b[8:], x[1])
+	binary.LittleEndian.PutUint64(w.b[16:], x[2])
+	w.w.Write(w.b[:])
+}
+
+func (w *recordWriter) Close() error {
+	err := w.w.Flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recordReader reads records from a file
+type recordReader struct {
+	f *os.File
+	r *bufio.Reader
+	b [recordSize]byte
+}
+
+func (s *extSorter) open(name string) (*recordReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &recordReader{f: f, r: bufio.NewReaderSize(f, s.bufSize)}, nil
+}
+
+// read returns the next record, or io.EOF after the last
+func (rr *recordReader) read() (record, error) {
+	if _, err := io.ReadFull(rr.r, rr.b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("sufsort: truncated run file %s", rr.f.Name())
+		}
+		return record{}, err
+	}
+	return record{
+		binary.LittleEndian.Uint64(rr.b[0:]),
+		binary.LittleEndian.Uint64(rr.b[8:]),
+		binary.LittleEndian.Uint64(rr.b[16:]),
+	}, nil
+}
+
+func (rr *recordReader) Close() error {
+	return rr.f.Close()
+}
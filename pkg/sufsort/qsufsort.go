@@ -0,0 +1,216 @@
+// * Copyright 2003-2005 Colin Percival
+// * All rights reserved
+// *
+// * Redistribution and use in source and binary forms, with or without
+// * modification, are permitted providing that the following conditions
+// * are met:
+// * 1. Redistributions of source code must retain the above copyright
+// *    notice, this list of conditions and the following disclaimer.
+// * 2. Redistributions in binary form must reproduce the above copyright
+// *    notice, this list of conditions and the following disclaimer in the
+// *    documentation and/or other materials provided with the distribution.
+// *
+// * THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// * IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// * DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// * POSSIBILITY OF SUCH DAMAGE.
+
+package sufsort
+
+import "github.com/kiteco/go-bsdiff/pkg/progress"
+
+func qsufsort(iii []int, buf []byte, r *progress.Reporter) error {
+	buckets := make([]int, 256)
+	vvv := make([]int, len(iii))
+	var i, h, ln int
+	bufzise := len(buf)
+
+	if err := r.Start(progress.Sorting, int64(bufzise+1)); err != nil {
+		return err
+	}
+
+	// -- Phase 0 --
+	// Bucket sort (into iii) the natural numbers i = 0, ..., len(buf) based on the value buf[i].
+
+	// count number of occurrences of each byte value
+	for i = 0; i < bufzise; i++ {
+		buckets[buf[i]]++
+	}
+
+	// prefix sum of buckets -> offsets into iii where each bucket starts
+	for i = 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i = 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	// populate iii based on bucket offsets
+	for i = 0; i < bufzise; i++ {
+		buckets[buf[i]]++
+		iii[buckets[buf[i]]] = i
+	}
+	iii[0] = bufzise
+
+	// vvv is the inverse of iii: for each index i = 0, ..., len(buf), store its sort ordering in iii.
+	for i = 0; i < bufzise; i++ {
+		vvv[i] = buckets[buf[i]]
+	}
+	vvv[bufzise] = 0
+
+	// At this point, iii contains the "1-order" of buf.
+	// The "h-order" for h>0 is the ordering of
+	//   - the substrings of buf of length exactly h, and
+	//   - the suffixes of buf of length less than h
+	// Note that there are exactly n non-empty strings in the h-order for all h,
+	// uniquely identified by their start offset in buf.
+
+	// Next, we track groups of consecutive suffixes already in their final positions by
+	// storing -x at the first such suffix in each group, where x in the size of the group.
+	// This is non-destructive, since we still have vvv, the inverse of iii.
+
+	// Currently, if a bucket has size 1, it's already in its final suffix-sort order.
+	// Otherwise, it may not be. So store -1 at all size-1 bucket positions.
+	// Note that groups are not yet "coalesced," so multiple groups may be adjacent.
+	for i = 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			iii[buckets[i]] = -1
+		}
+	}
+	iii[0] = -1
+
+	// -- Phase 1 --
+	// Repeatedly double h, maintaining vvv = the inverse of the h-order of buf.
+	// Coalesce groups of suffixes in their final positions, indicated by negative values in iii.
+	for h = 1; iii[0] != -(bufzise + 1); h += h {
+		ln = 0 // used to track the size of the coalesced group
+
+		// sorted counts the suffixes in their final positions for the progress
+		// report, check the next position at which to look at the context
+		sorted, check := 0, checkEvery
+		i = 0
+		for i < bufzise+1 {
+			if i >= check {
+				if err := r.Err(); err != nil {
+					return err
+				}
+				check = i + checkEvery
+			}
+			if iii[i] < 0 {
+				// at a group of suffixes in their final positions, skip it
+				sorted -= iii[i]
+				ln -= iii[i]
+				i -= iii[i]
+			} else {
+				if ln != 0 {
+					// coalesce all the groups we just saw into one.
+					iii[i-ln] = -ln
+				}
+				// TODO(naman) when would this not be 1?
+				ln = vvv[iii[i]] + 1 - i
+				split(iii, vvv, i, ln, h)
+				i += ln
+				ln = 0
+			}
+		}
+		if ln != 0 {
+			iii[i-ln] = -ln
+		}
+		if err := r.Update(int64(sorted)); err != nil {
+			return err
+		}
+	}
+
+	for i = 0; i < bufzise+1; i++ {
+		iii[vvv[i]] = i
+	}
+	return r.Finish()
+}
+
+// checkEvery is how many suffixes qsufsort sorts between context checks
+const checkEvery = 1 << 20
+
+func split(iii, vvv []int, start, ln, h int) {
+	var i, j, k, x int
+
+	if ln < 16 {
+		for k = start; k < start+ln; k += j {
+			j = 1
+			x = vvv[iii[k]+h]
+			for i = 1; k+i < start+ln; i++ {
+				if vvv[iii[k+i]+h] < x {
+					x = vvv[iii[k+i]+h]
+					j = 0
+				}
+				if vvv[iii[k+i]+h] == x {
+					iii[k+j], iii[k+i] = iii[k+i], iii[k+j]
+					j++
+				}
+			}
+			for i = 0; i < j; i++ {
+				vvv[iii[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				iii[k] = -1
+			}
+		}
+		return
+	}
+
+	x = vvv[iii[start+(ln/2)]+h]
+	var jj, kk int
+	for i = start; i < start+ln; i++ {
+		if vvv[iii[i]+h] < x {
+			jj++
+		} else if vvv[iii[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i = start
+	j = 0
+	k = 0
+	for i < jj {
+		if vvv[iii[i]+h] < x {
+			i++
+		} else if vvv[iii[i]+h] == x {
+			iii[i], iii[jj+j] = iii[jj+j], iii[i]
+			j++
+		} else {
+			iii[i], iii[kk+k] = iii[kk+k], iii[i]
+			k++
+		}
+	}
+	for jj+j < kk {
+		if vvv[iii[jj+j]+h] == x {
+			j++
+		} else {
+			iii[jj+j], iii[kk+k] = iii[kk+k], iii[jj+j]
+			k++
+		}
+	}
+	if jj > start {
+		split(iii, vvv, start, jj-start, h)
+	}
+
+	for i = 0; i < kk-jj; i++ {
+		vvv[iii[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		iii[jj] = -1
+	}
+
+	if start+ln > kk {
+		split(iii, vvv, kk, start+ln-kk, h)
+	}
+}
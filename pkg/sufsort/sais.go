@@ -0,0 +1,522 @@
+package sufsort
+
+import "github.com/kiteco/go-bsdiff/pkg/progress"
+
+// The passes of sais exist twice: sais8 sorts the input bytes, sais32 the
+// names of the LMS substrings in the recursion. Reading the text through an
+// interface made every character an indirect call.
+
+// saisStep is the number of entries a pass handles between two progress
+// reports, which check for cancellation
+const saisStep = 1 << 16
+
+// saisSteps estimates the steps of sais per input byte: about 10 passes over
+// the input at the top level and 15 passes over a third of it or less in the
+// recursion
+const saisSteps = 16
+
+// saisProgress reports the steps of sais as a share of the input bytes and
+// checks for cancellation every saisStep steps, so a large sort stops promptly
+type saisProgress struct {
+	r     *progress.Reporter
+	n     int64
+	steps int64
+}
+
+// add counts m steps
+func (p *saisProgress) add(m int) error {
+	p.steps += int64(m)
+	done := p.steps / saisSteps
+	if done > p.n {
+		// the estimate was short, Finish reports the end
+		done = p.n
+	}
+	if err := p.r.Update(done); err != nil {
+		return err
+	}
+	return p.r.Err()
+}
+
+// blockEnd returns the end of the block of a pass over n entries starting
+// at lo
+func blockEnd(lo, n int) int {
+	if n-lo > saisStep {
+		return lo + saisStep
+	}
+	return n
+}
+
+// blockStart returns the start of the block of a backward pass ending at hi
+func blockStart(hi int) int {
+	if hi > saisStep {
+		return hi - saisStep
+	}
+	return 0
+}
+
+// saisMemory returns the bytes sais allocates besides the suffix array to sort
+// n bytes: the type bitsets of all levels, n/8 bytes at the top and at most
+// half as much in every recursion, and the bucket arrays of the recursion that
+// do not fit in the free entries of sa. sais32 only allocates one larger than
+// every free space above it, which bounds them to n/2 entries in total.
+func saisMemory(n int64) int64 {
+	const levels = 32 // a bitset rounds up to 8 bytes, sa holds 2^31 entries
+	return n/4 + 4*(n/2) + levels*(8+4*256)
+}
+
+// bitset records the type of every suffix: set for S, clear for L
+type bitset []uint64
+
+func newBitset(n int) bitset    { return make(bitset, (n+63)/64) }
+func (b bitset) set(i int)      { b[uint(i)/64] |= 1 << (uint(i) % 64) }
+func (b bitset) get(i int) bool { return b[uint(i)/64]&(1<<(uint(i)%64)) != 0 }
+
+// lms reports whether suffix i, 0 < i < n, is an LMS suffix
+func (b bitset) lms(i int) bool { return b.get(i) && !b.get(i-1) }
+
+// sais8 writes the suffix array of t to sa. The end of t is treated as a
+// sentinel smaller than every character.
+//
+// Suffix i is S-type if it is smaller than suffix i+1 and L-type otherwise;
+// LMS (leftmost S) suffixes are S-type suffixes following an L-type one. The
+// LMS substrings are sorted by induction, named, and the string of names is
+// sorted recursively when the names are not unique. The sorted LMS suffixes
+// then induce the order of all others.
+func sais8(t []byte, sa []int32, p *saisProgress) error {
+	n := len(t)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		sa[0] = 0
+		return nil
+	}
+	if err := p.r.Err(); err != nil {
+		return err
+	}
+
+	// classify the suffixes; the last one is L-type as it precedes the sentinel
+	stype := newBitset(n)
+	for hi := n - 1; hi > 0; hi -= saisStep {
+		lo := blockStart(hi)
+		for i := hi - 1; i >= lo; i-- {
+			if c, d := t[i], t[i+1]; c < d || (c == d && stype.get(i+1)) {
+				stype.set(i)
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	// the buckets are derived from the counts of the characters
+	var freq, bkt [256]int32
+	for lo := 0; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for _, c := range t[lo:hi] {
+			freq[c]++
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	// Stage 1: sort the LMS substrings by placing the LMS suffixes at the ends
+	// of their buckets and inducing
+	bucketEnds(freq[:], bkt[:])
+	for i := range sa {
+		sa[i] = -1
+	}
+	for lo := 1; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for i := lo; i < hi; i++ {
+			if stype.lms(i) {
+				c := t[i]
+				bkt[c]--
+				sa[bkt[c]] = int32(i)
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+	if err := induce8(t, sa, &freq, &bkt, stype, p); err != nil {
+		return err
+	}
+
+	n1, err := compactLMS(sa, stype, p)
+	if err != nil {
+		return err
+	}
+
+	// name the LMS substrings, equal substrings get the same name; the name of
+	// the substring at pos goes to sa[n1+pos/2], LMS positions are at least two
+	// apart
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+	name, prev := 0, -1
+	for lo := 0; lo < n1; lo += saisStep {
+		hi := blockEnd(lo, n1)
+		for i := lo; i < hi; i++ {
+			pos := int(sa[i])
+			diff := false
+			for d := 0; ; d++ {
+				if prev == -1 || pos+d == n || prev+d == n ||
+					t[pos+d] != t[prev+d] || stype.get(pos+d) != stype.get(prev+d) {
+					diff = true
+					break
+				}
+				if d > 0 && (stype.lms(pos+d) || stype.lms(prev+d)) {
+					break
+				}
+			}
+			if diff {
+				name++
+				prev = pos
+			}
+			sa[n1+pos/2] = int32(name - 1)
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	if err := sortNames(sa, n1, name, bkt[:], p); err != nil {
+		return err
+	}
+
+	// Stage 3: put the sorted LMS suffixes at the ends of their buckets and
+	// induce the rest
+	if err := orderLMS(sa, n1, stype, p); err != nil {
+		return err
+	}
+	bucketEnds(freq[:], bkt[:])
+	for i := n1 - 1; i >= 0; i-- {
+		j := sa[i]
+		sa[i] = -1
+		c := t[j]
+		bkt[c]--
+		sa[bkt[c]] = j
+	}
+	return induce8(t, sa, &freq, &bkt, stype, p)
+}
+
+// induce8 sorts the L-type suffixes from the S-type ones in sa, then the
+// S-type suffixes from the L-type ones
+func induce8(t []byte, sa []int32, freq, bkt *[256]int32, stype bitset, p *saisProgress) error {
+	n := len(t)
+
+	bucketStarts(freq[:], bkt[:])
+	// the suffix before the sentinel is the smallest L-type one
+	c := t[n-1]
+	sa[bkt[c]] = int32(n - 1)
+	bkt[c]++
+	for lo := 0; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for i := lo; i < hi; i++ {
+			if j := int(sa[i]) - 1; j >= 0 && !stype.get(j) {
+				c := t[j]
+				sa[bkt[c]] = int32(j)
+				bkt[c]++
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	bucketEnds(freq[:], bkt[:])
+	for hi := n; hi > 0; hi -= saisStep {
+		lo := blockStart(hi)
+		for i := hi - 1; i >= lo; i-- {
+			if j := int(sa[i]) - 1; j >= 0 && stype.get(j) {
+				c := t[j]
+				bkt[c]--
+				sa[bkt[c]] = int32(j)
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sais32 is sais8 for the string t of names in [0, k) of the recursion. Its
+// bucket array is taken from tmp, free entries of the levels above, when it
+// fits; the names are counted again for every use of the buckets.
+func sais32(t []int32, sa []int32, k int, tmp []int32, p *saisProgress) error {
+	n := len(t)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		sa[0] = 0
+		return nil
+	}
+	if err := p.r.Err(); err != nil {
+		return err
+	}
+
+	stype := newBitset(n)
+	for hi := n - 1; hi > 0; hi -= saisStep {
+		lo := blockStart(hi)
+		for i := hi - 1; i >= lo; i-- {
+			if c, d := t[i], t[i+1]; c < d || (c == d && stype.get(i+1)) {
+				stype.set(i)
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	if len(tmp) < k {
+		tmp = make([]int32, k)
+	}
+	bkt := tmp[:k]
+
+	// Stage 1
+	if err := getBuckets32(t, bkt, true, p); err != nil {
+		return err
+	}
+	for i := range sa {
+		sa[i] = -1
+	}
+	for lo := 1; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for i := lo; i < hi; i++ {
+			if stype.lms(i) {
+				c := t[i]
+				bkt[c]--
+				sa[bkt[c]] = int32(i)
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+	if err := induce32(t, sa, bkt, stype, p); err != nil {
+		return err
+	}
+
+	n1, err := compactLMS(sa, stype, p)
+	if err != nil {
+		return err
+	}
+
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+	name, prev := 0, -1
+	for lo := 0; lo < n1; lo += saisStep {
+		hi := blockEnd(lo, n1)
+		for i := lo; i < hi; i++ {
+			pos := int(sa[i])
+			diff := false
+			for d := 0; ; d++ {
+				if prev == -1 || pos+d == n || prev+d == n ||
+					t[pos+d] != t[prev+d] || stype.get(pos+d) != stype.get(prev+d) {
+					diff = true
+					break
+				}
+				if d > 0 && (stype.lms(pos+d) || stype.lms(prev+d)) {
+					break
+				}
+			}
+			if diff {
+				name++
+				prev = pos
+			}
+			sa[n1+pos/2] = int32(name - 1)
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	// the recursion may use tmp, bkt is counted again below
+	if err := sortNames(sa, n1, name, tmp, p); err != nil {
+		return err
+	}
+
+	// Stage 3
+	if err := orderLMS(sa, n1, stype, p); err != nil {
+		return err
+	}
+	if err := getBuckets32(t, bkt, true, p); err != nil {
+		return err
+	}
+	for i := n1 - 1; i >= 0; i-- {
+		j := sa[i]
+		sa[i] = -1
+		c := t[j]
+		bkt[c]--
+		sa[bkt[c]] = j
+	}
+	return induce32(t, sa, bkt, stype, p)
+}
+
+// induce32 is induce8 for sais32
+func induce32(t []int32, sa, bkt []int32, stype bitset, p *saisProgress) error {
+	n := len(t)
+
+	if err := getBuckets32(t, bkt, false, p); err != nil {
+		return err
+	}
+	c := t[n-1]
+	sa[bkt[c]] = int32(n - 1)
+	bkt[c]++
+	for lo := 0; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for i := lo; i < hi; i++ {
+			if j := int(sa[i]) - 1; j >= 0 && !stype.get(j) {
+				c := t[j]
+				sa[bkt[c]] = int32(j)
+				bkt[c]++
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+
+	if err := getBuckets32(t, bkt, true, p); err != nil {
+		return err
+	}
+	for hi := n; hi > 0; hi -= saisStep {
+		lo := blockStart(hi)
+		for i := hi - 1; i >= lo; i-- {
+			if j := int(sa[i]) - 1; j >= 0 && stype.get(j) {
+				c := t[j]
+				bkt[c]--
+				sa[bkt[c]] = int32(j)
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBuckets32 sets bkt[c] to the start, or the end if end is set, of the
+// bucket of the suffixes of t starting with c
+func getBuckets32(t []int32, bkt []int32, end bool, p *saisProgress) error {
+	for i := range bkt {
+		bkt[i] = 0
+	}
+	for lo := 0; lo < len(t); lo += saisStep {
+		hi := blockEnd(lo, len(t))
+		for _, c := range t[lo:hi] {
+			bkt[c]++
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+	if end {
+		bucketEnds(bkt, bkt)
+	} else {
+		bucketStarts(bkt, bkt)
+	}
+	return nil
+}
+
+// bucketStarts sets bkt[c] to the start of the bucket of c from the counts
+// in freq, which may be bkt
+func bucketStarts(freq, bkt []int32) {
+	var sum int32
+	for c, f := range freq {
+		bkt[c] = sum
+		sum += f
+	}
+}
+
+// bucketEnds sets bkt[c] to the end of the bucket of c from the counts in
+// freq, which may be bkt
+func bucketEnds(freq, bkt []int32) {
+	var sum int32
+	for c, f := range freq {
+		sum += f
+		bkt[c] = sum
+	}
+}
+
+// compactLMS moves the sorted LMS substrings in sa to its first n1 entries
+// and returns n1
+func compactLMS(sa []int32, stype bitset, p *saisProgress) (int, error) {
+	n, n1 := len(sa), 0
+	for lo := 0; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for _, j := range sa[lo:hi] {
+			if j > 0 && stype.lms(int(j)) {
+				sa[n1] = j
+				n1++
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return 0, err
+		}
+	}
+	return n1, nil
+}
+
+// sortNames is Stage 2: it moves the names in sa[n1:] to the end of sa and
+// sorts the string of them into sa[:n1], recursing unless the names are
+// unique. The recursion takes its bucket array from the free middle of sa or
+// from tmp, the unused buckets of this level, whichever is larger.
+func sortNames(sa []int32, n1, name int, tmp []int32, p *saisProgress) error {
+	n := len(sa)
+	for i, j := n-1, n-1; i >= n1; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j--
+		}
+	}
+	if err := p.add(n - n1); err != nil {
+		return err
+	}
+
+	s1 := sa[n-n1:]
+	sa1 := sa[:n1]
+	if name < n1 {
+		if free := sa[n1 : n-n1]; len(free) > len(tmp) {
+			tmp = free
+		}
+		return sais32(s1, sa1, name, tmp, p)
+	}
+	for i := 0; i < n1; i++ {
+		sa1[s1[i]] = int32(i)
+	}
+	return p.r.Err()
+}
+
+// orderLMS replaces the sorted indexes of the LMS suffixes in sa[:n1] with
+// their positions and clears the rest of sa
+func orderLMS(sa []int32, n1 int, stype bitset, p *saisProgress) error {
+	n := len(sa)
+	s1 := sa[n-n1:]
+	j := 0
+	for lo := 1; lo < n; lo += saisStep {
+		hi := blockEnd(lo, n)
+		for i := lo; i < hi; i++ {
+			if stype.lms(i) {
+				s1[j] = int32(i)
+				j++
+			}
+		}
+		if err := p.add(hi - lo); err != nil {
+			return err
+		}
+	}
+	sa1 := sa[:n1]
+	for i := range sa1 {
+		sa1[i] = s1[sa1[i]]
+	}
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Package sufsort builds the suffix arrays bsdiff searches for matches.
+package sufsort
+
+import (
+	"math"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// Array is the suffix array of a buffer of n bytes. It has n+1 entries: At(0)
+// is n, the empty suffix, followed by the offsets of the other suffixes in
+// increasing order.
+type Array interface {
+	Len() int
+	At(i int) int
+}
+
+// Ints is an Array of int offsets
+type Ints []int
+
+// Len returns the number of entries
+func (a Ints) Len() int { return len(a) }
+
+// At returns the offset of the i-th smallest suffix
+func (a Ints) At(i int) int { return a[i] }
+
+// Int32s is an Array of int32 offsets, for buffers smaller than 2 GiB
+type Int32s []int32
+
+// Len returns the number of entries
+func (a Int32s) Len() int { return len(a) }
+
+// At returns the offset of the i-th smallest suffix
+func (a Int32s) At(i int) int { return int(a[i]) }
+
+// Sorter is a suffix array construction algorithm. Sort reports the
+// progress.Sorting phase to r, which may be nil, and returns its context
+// error when cancelled.
+type Sorter interface {
+	Name() string
+	Sort(buf []byte, r *progress.Reporter) (Array, error)
+}
+
+// MemoryEstimator is implemented by sorters that know about how much memory
+// they need
+type MemoryEstimator interface {
+	// Memory returns the bytes needed to sort n bytes
+	Memory(n int64) int64
+}
+
+// Memory returns about how much memory s needs to sort n bytes, or 16 bytes
+// per byte as for QSufSort if s does not implement MemoryEstimator
+func Memory(s Sorter, n int64) int64 {
+	if m, ok := s.(MemoryEstimator); ok {
+		return m.Memory(n)
+	}
+	return QSufSort{}.Memory(n)
+}
+
+// QSufSort is the Larsson-Sadakane algorithm of the original bsdiff. It takes
+// O(n log n) time and 16 bytes per input byte on 64 bit platforms.
+type QSufSort struct{}
+
+// Name returns "qsufsort"
+func (QSufSort) Name() string { return "qsufsort" }
+
+// Memory implements MemoryEstimator
+func (QSufSort) Memory(n int64) int64 { return 16 * (n + 1) }
+
+// Sort returns the suffix array of buf
+func (QSufSort) Sort(buf []byte, r *progress.Reporter) (Array, error) {
+	iii := make([]int, len(buf)+1)
+	if err := qsufsort(iii, buf, r); err != nil {
+		return nil, err
+	}
+	return Ints(iii), nil
+}
+
+// SAIS is the linear time induced sorting algorithm of Nong, Zhang and Chan.
+// It uses int32 offsets, 4 to 6.25 bytes per input byte in total; buffers of
+// 2 GiB and more are sorted with QSufSort instead.
+type SAIS struct{}
+
+// Name returns "sais"
+func (SAIS) Name() string { return "sais" }
+
+// Memory implements MemoryEstimator. Besides the array the recursion needs up
+// to 2.25 bytes per byte for some inputs, see saisMemory.
+func (SAIS) Memory(n int64) int64 {
+	if n >= math.MaxInt32 {
+		return QSufSort{}.Memory(n)
+	}
+	return 4*(n+1) + saisMemory(n)
+}
+
+// Sort returns the suffix array of buf
+func (SAIS) Sort(buf []byte, r *progress.Reporter) (Array, error) {
+	if int64(len(buf)) >= math.MaxInt32 {
+		return QSufSort{}.Sort(buf, r)
+	}
+	if err := r.Start(progress.Sorting, int64(len(buf)+1)); err != nil {
+		return nil, err
+	}
+	sa := make([]int32, len(buf)+1)
+	sa[0] = int32(len(buf))
+	if err := sais8(buf, sa[1:], &saisProgress{r: r, n: int64(len(buf))}); err != nil {
+		return nil, err
+	}
+	return Int32s(sa), r.Finish()
+}
+
+// Default is the Sorter used by bsdiff unless another one is configured
+var Default Sorter = SAIS{}
@@ -0,0 +1,207 @@
+package sufsort
+
+import (
+	"bytes"
+	"context"
+	"index/suffixarray"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/kiteco/go-bsdiff/pkg/progress"
+)
+
+// naive sorts the suffixes with bytes.Compare
+func naive(buf []byte) []int {
+	sa := make([]int, len(buf)+1)
+	for i := range sa {
+		sa[i] = i
+	}
+	sort.Slice(sa, func(i, j int) bool {
+		return bytes.Compare(buf[sa[i]:], buf[sa[j]:]) < 0
+	})
+	return sa
+}
+
+func testInputs() [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	inputs := [][]byte{
+		{},
+		{0},
+		{1, 1},
+		[]byte("banana"),
+		[]byte("mississippi"),
+		[]byte("abracadabra abracadabra"),
+		bytes.Repeat([]byte{0}, 1000),
+		bytes.Repeat([]byte("ab"), 500),
+		bytes.Repeat([]byte("abcabd"), 300),
+	}
+	for _, n := range []int{10, 100, 1000, 10000} {
+		for _, alphabet := range []int{2, 4, 256} {
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = byte(rnd.Intn(alphabet))
+			}
+			inputs = append(inputs, b)
+		}
+	}
+	return inputs
+}
+
+func TestSorters(t *testing.T) {
+	for _, s := range []Sorter{QSufSort{}, SAIS{}} {
+		for _, buf := range testInputs() {
+			want := naive(buf)
+			sa, err := s.Sort(buf, nil)
+			if err != nil {
+				t.Fatal(s.Name(), err)
+			}
+			if sa.Len() != len(want) {
+				t.Fatal(s.Name(), "length", sa.Len(), "want", len(want))
+			}
+			for i := range want {
+				if sa.At(i) != want[i] {
+					t.Fatalf("%s: %q: entry %v is %v, want %v", s.Name(), buf, i, sa.At(i), want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestSortCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buf := bytes.Repeat([]byte("abcabd"), 1000)
+	for _, s := range []Sorter{QSufSort{}, SAIS{}, External{MemoryLimit: 1}} {
+		if _, err := s.Sort(buf, progress.NewReporter(ctx, nil)); err != context.Canceled {
+			t.Fatal(s.Name(), "expected a cancelled sort, got", err)
+		}
+	}
+}
+
+func TestSAISProgress(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	buf := make([]byte, 1<<20)
+	for i := range buf {
+		buf[i] = byte(rnd.Intn(4))
+	}
+	var reports int
+	var last int64
+	_, err := SAIS{}.Sort(buf, progress.NewReporter(nil, func(phase progress.Phase, done, total int64) {
+		if done < last || done > total {
+			t.Fatal("report of", done, "after", last, "of", total)
+		}
+		reports, last = reports+1, done
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the passes report along the way, not just at the start and the end
+	if reports < 100 || last != int64(len(buf)+1) {
+		t.Fatal(reports, "reports up to", last)
+	}
+
+	// cancel once the sort is under way
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reports = 0
+	_, err = SAIS{}.Sort(buf, progress.NewReporter(ctx, func(phase progress.Phase, done, total int64) {
+		reports++
+		if done > total/4 {
+			cancel()
+		}
+	}))
+	if err != context.Canceled {
+		t.Fatal("expected a cancelled sort, got", err)
+	}
+	if reports > 100 {
+		t.Fatal("sort went on after cancellation,", reports, "reports")
+	}
+}
+
+func TestSAISMemory(t *testing.T) {
+	for _, buf := range append(testInputs(), bytes.Repeat([]byte("abcabd"), 100000)) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := (SAIS{}).Sort(buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		n := int64(len(buf))
+		want := SAIS{}.Memory(n)
+		if got := int64(after.TotalAlloc - before.TotalAlloc); got > want {
+			t.Errorf("sorting %d bytes allocated %d bytes, more than the estimate of %d", n, got, want)
+		}
+	}
+}
+
+func BenchmarkSorters(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 1<<20)
+	for i := range buf {
+		buf[i] = byte(rnd.Intn(16))
+	}
+	for _, s := range []Sorter{QSufSort{}, SAIS{}} {
+		b.Run(s.Name(), func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Sort(buf, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	// the SA-IS of the standard library, for reference
+	b.Run("index/suffixarray", func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			suffixarray.New(buf)
+		}
+	})
+}
+
+func TestExternal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sufsort-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a tiny memory limit sorts on disk in many runs and merge passes
+	s := External{Dir: dir, MemoryLimit: 1}
+	inputs := append(testInputs(), bytes.Repeat([]byte{0}, 5000), bytes.Repeat([]byte("abc\x00"), 3000))
+	for _, buf := range inputs {
+		want := naive(buf)
+		sa, err := s.Sort(buf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sa.Len() != len(want) {
+			t.Fatal("length", sa.Len(), "want", len(want))
+		}
+		for i := range want {
+			if sa.At(i) != want[i] {
+				t.Fatalf("%q: entry %v is %v, want %v", buf, i, sa.At(i), want[i])
+			}
+		}
+		if err := sa.(io.Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+		if left, _ := ioutil.ReadDir(dir); len(left) != 0 {
+			t.Fatalf("%v files left in the scratch directory", len(left))
+		}
+	}
+
+	// inputs that fit are sorted in memory
+	sa, err := External{Dir: dir}.Sort([]byte("banana"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sa.(Int32s); !ok {
+		t.Fatalf("sorted into a %T", sa)
+	}
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// MappedFile is the read-only contents of a file. Where the platform supports
+// it the file is memory mapped, so its contents are not copied onto the heap;
+// otherwise it is read into memory.
+//
+// The contents of a mapped file change with the file, and reading a mapped
+// file that was truncated crashes the program, so it must not be modified
+// while it is open.
+type MappedFile struct {
+	data   []byte
+	mapped bool
+}
+
+// ReadFile reads the file name into memory without mapping it, for contents
+// that may be used after Close
+func ReadFile(name string) (*MappedFile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{data: data}, nil
+}
+
+// Bytes returns the contents of the file, valid until Close
+func (m *MappedFile) Bytes() []byte {
+	return m.data
+}
+
+// Mapped reports whether the file is memory mapped
+func (m *MappedFile) Mapped() bool {
+	return m.mapped
+}
+
+// SameFile reports whether the files a and b exist and are the same file.
+// Writing to a file that is also mapped as an input must be avoided.
+func SameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// OpenMapped maps the file name into memory, or reads it if it can not be
+// mapped, such as pipes and files of some special file systems
+func OpenMapped(name string) (*MappedFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size > 0 && fi.Mode().IsRegular() {
+		if int64(int(size)) != size {
+			return nil, fmt.Errorf("%s is too large to be mapped (%v bytes)", name, size)
+		}
+		data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err == nil {
+			return &MappedFile{data: data, mapped: true}, nil
+		}
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{data: data}, nil
+}
+
+// Close unmaps the file
+func (m *MappedFile) Close() error {
+	data := m.data
+	m.data = nil
+	if !m.mapped || data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOpenMappedFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(name, 0600); err != nil {
+		t.Skip("no fifo:", err)
+	}
+
+	data := bytes.Repeat([]byte{1, 2, 3}, 100000)
+	written := make(chan error, 1)
+	go func() {
+		written <- ioutil.WriteFile(name, data, 0600)
+	}()
+	// a fifo can not be mapped and is read instead
+	m, err := OpenMapped(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if m.Mapped() || !bytes.Equal(m.Bytes(), data) {
+		t.Fatal("fifo read as", len(m.Bytes()), "bytes, mapped", m.Mapped())
+	}
+}
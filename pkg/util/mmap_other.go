@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+// OpenMapped reads the file name into memory; files are only mapped on Linux
+func OpenMapped(name string) (*MappedFile, error) {
+	return ReadFile(name)
+}
+
+// Close releases the contents of the file
+func (m *MappedFile) Close() error {
+	m.data = nil
+	return nil
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOpenMapped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, data := range [][]byte{nil, []byte("bsdiff"), bytes.Repeat([]byte{1, 2, 3}, 10000)} {
+		name := filepath.Join(dir, "f")
+		if err := ioutil.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := OpenMapped(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.Bytes(), data) {
+			t.Fatal(len(data), "bytes differ")
+		}
+		if m.Mapped() != (runtime.GOOS == "linux" && len(data) > 0) {
+			t.Fatal("unexpected mapping state", m.Mapped())
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !SameFile(name, name) || SameFile(name, dir) {
+			t.Fatal("SameFile")
+		}
+	}
+
+	if _, err := OpenMapped(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}